@@ -0,0 +1,109 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Callers are authorized by the role and org attributes of their enrollment
+// certificate. Auditors may only query. Writers may also create and change
+// marketers and assignments whose orgName is their org, and assignments may
+// only reference marketers of that org and accounts of that org or of none.
+// Admins may do anything, including the account, delete and maintenance
+// functions.
+const (
+	roleAttribute = "role"
+	orgAttribute  = "org"
+
+	roleAdmin   = "admin"
+	roleWriter  = "writer"
+	roleAuditor = "auditor"
+)
+
+// roleRank orders the roles; each may do what the lower ones may.
+var roleRank = map[string]int{
+	roleAuditor: 1,
+	roleWriter:  2,
+	roleAdmin:   3,
+}
+
+// invokeRoles is the lowest role allowed to call each invoke function.
+// Functions not listed are admin-only.
+var invokeRoles = map[string]string{
+	"write":             roleWriter,
+	"writeLegacy":       roleWriter,
+	"assign":            roleWriter,
+	"assignLegacy":      roleWriter,
+	"updateMarketer":    roleWriter,
+	"suspendMarketer":   roleWriter,
+	"terminateMarketer": roleWriter,
+	"reinstateMarketer": roleWriter,
+	"updateAssignment":  roleWriter,
+}
+
+// callerAttr reads a certificate attribute of the caller, "" when absent.
+func callerAttr(stub shim.ChaincodeStubInterface, name string) string {
+	value, err := stub.ReadCertAttribute(name)
+	if err != nil {
+		return ""
+	}
+
+	return string(value)
+}
+
+// requireRole fails with FORBIDDEN unless the caller holds role or a higher one.
+func requireRole(stub shim.ChaincodeStubInterface, function, role string) error {
+	callerRole := callerAttr(stub, roleAttribute)
+	if roleRank[callerRole] == 0 {
+		return newError(codeForbidden, "Caller certificate carries no known role").withField(roleAttribute)
+	}
+	if roleRank[callerRole] < roleRank[role] {
+		return errorf(codeForbidden, "Role %s may not call %s", callerRole, function)
+	}
+
+	return nil
+}
+
+// authorizeInvoke checks the caller's role against invokeRoles.
+func authorizeInvoke(stub shim.ChaincodeStubInterface, function string) error {
+	role, ok := invokeRoles[function]
+	if !ok {
+		role = roleAdmin
+	}
+
+	return requireRole(stub, function, role)
+}
+
+// authorizeQuery lets any known role query.
+func authorizeQuery(stub shim.ChaincodeStubInterface, function string) error {
+	return requireRole(stub, function, roleAuditor)
+}
+
+// checkOrg fails with FORBIDDEN when a writer touches a record of another
+// org. Every orgName the operation reads or writes must be passed.
+func checkOrg(stub shim.ChaincodeStubInterface, key string, orgNames ...string) error {
+	if callerAttr(stub, roleAttribute) == roleAdmin {
+		return nil
+	}
+
+	org := callerAttr(stub, orgAttribute)
+	for _, orgName := range orgNames {
+		if org == "" || orgName != org {
+			return errorf(codeForbidden, "Record belongs to org %q, not the caller's org %q", orgName, org).withField("orgName").withKey(key)
+		}
+	}
+
+	return nil
+}
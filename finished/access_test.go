@@ -0,0 +1,93 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+// setupOrgs writes a marketer of OrgA and one of OrgB, a shared account and
+// an account of OrgB, and makes the caller a writer of OrgA.
+func setupOrgs(t *testing.T) (*SimpleChaincode, *testStub) {
+	cc, stub := newTestStub(t)
+	stub.mustInvoke(t, cc, "write", `{"eId":"EA","taxId":"111-11-1111","legalName":"Al Ames","marketerEffectiveDate":"2017-01-01","orgName":"OrgA"}`)
+	stub.mustInvoke(t, cc, "write", `{"eId":"EB","taxId":"222-22-2222","legalName":"Bea Bell","marketerEffectiveDate":"2017-01-01","orgName":"OrgB"}`)
+	stub.mustInvoke(t, cc, "account", `{"policyPrefix":"P","accountNumber":"A1","accountStatus":"Active","accountEffectiveDate":"2017-01-01"}`)
+	stub.mustInvoke(t, cc, "account", `{"policyPrefix":"P","accountNumber":"A2","accountStatus":"Active","accountEffectiveDate":"2017-01-01","orgName":"OrgB"}`)
+	stub.attrs = map[string]string{roleAttribute: roleWriter, orgAttribute: "OrgA", identityAttribute: "writer"}
+
+	return cc, stub
+}
+
+func TestRolesLimitFunctions(t *testing.T) {
+	cc, stub := setupOrgs(t)
+
+	for _, call := range [][]string{
+		{"init", "hello"},
+		{"account", `{"policyPrefix":"P","accountNumber":"A3","accountEffectiveDate":"2017-01-01"}`},
+		{"updateAccount", `{"policyPrefix":"P","accountNumber":"A1","marketerProduct":"Term"}`},
+		{"deleteMarketer", "EA"},
+		{"deleteAccount", "P", "A1"},
+		{"rollForward"},
+		{"migrateKeys"},
+	} {
+		if payload, err := stub.invoke(cc, call[0], call[1:]...); errorCode(err) != codeForbidden {
+			t.Errorf("writer calling %s: got %q, %v; want a %s error", call[0], payload, err, codeForbidden)
+		}
+	}
+
+	stub.attrs[roleAttribute] = roleAuditor
+	for _, call := range [][]string{
+		{"write", `{"eId":"EC","taxId":"333-33-3333","legalName":"Cy Cole","orgName":"OrgA"}`},
+		{"updateMarketer", `{"eId":"EA","legalName":"Al Amos"}`},
+		{"suspendMarketer", "EA", "2017-02-01"},
+	} {
+		if payload, err := stub.invoke(cc, call[0], call[1:]...); errorCode(err) != codeForbidden {
+			t.Errorf("auditor calling %s: got %q, %v; want a %s error", call[0], payload, err, codeForbidden)
+		}
+	}
+	if _, err := cc.Query(stub, "readMarketer", []string{"EA"}); err != nil {
+		t.Errorf("auditor reading a marketer: %v", err)
+	}
+
+	delete(stub.attrs, roleAttribute)
+	if payload, err := cc.Query(stub, "readMarketer", []string{"EA"}); errorCode(err) != codeForbidden {
+		t.Errorf("caller without a role reading a marketer: got %q, %v; want a %s error", payload, err, codeForbidden)
+	}
+}
+
+func TestWritersStayInTheirOrg(t *testing.T) {
+	cc, stub := setupOrgs(t)
+
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"EA","legalName":"Al Amos"}`)
+	stub.mustInvoke(t, cc, "assign", `{"assignmentId":"S1","eId":"EA","ownerEId":"EA","policyPrefix":"P","accountNumber":"A1","splitPercentage":"50","assignmentEffectiveDate":"2017-06-01","orgName":"OrgA"}`)
+
+	for _, call := range []struct{ what, function, arg string }{
+		{"a marketer of another org", "write", `{"eId":"EC","taxId":"333-33-3333","legalName":"Cy Cole","orgName":"OrgB"}`},
+		{"a marketer of another org", "updateMarketer", `{"eId":"EB","legalName":"Bea Bello"}`},
+		{"a marketer into another org", "updateMarketer", `{"eId":"EA","orgName":"OrgB"}`},
+		{"an assignment of another org", "assign", `{"assignmentId":"S2","eId":"EA","ownerEId":"EA","policyPrefix":"P","accountNumber":"A1","splitPercentage":"10","assignmentEffectiveDate":"2017-06-01","orgName":"OrgB"}`},
+		{"an assignment to a marketer of another org", "assign", `{"assignmentId":"S3","eId":"EB","ownerEId":"EA","policyPrefix":"P","accountNumber":"A1","splitPercentage":"10","assignmentEffectiveDate":"2017-06-01","orgName":"OrgA"}`},
+		{"an assignment owned by a marketer of another org", "assign", `{"assignmentId":"S4","eId":"EA","ownerEId":"EB","policyPrefix":"P","accountNumber":"A1","splitPercentage":"10","assignmentEffectiveDate":"2017-06-01","orgName":"OrgA"}`},
+		{"an assignment to an account of another org", "assign", `{"assignmentId":"S5","eId":"EA","ownerEId":"EA","policyPrefix":"P","accountNumber":"A2","splitPercentage":"10","assignmentEffectiveDate":"2017-06-01","orgName":"OrgA"}`},
+		{"an assignment to a marketer of another org", "updateAssignment", `{"assignmentId":"S1","eId":"EB"}`},
+	} {
+		if payload, err := stub.invoke(cc, call.function, call.arg); errorCode(err) != codeForbidden {
+			t.Errorf("writer of OrgA writing %s with %s: got %q, %v; want a %s error", call.what, call.function, payload, err, codeForbidden)
+		}
+	}
+
+	stub.attrs[roleAttribute] = roleAdmin
+	stub.mustInvoke(t, cc, "assign", `{"assignmentId":"S5","eId":"EB","ownerEId":"EA","policyPrefix":"P","accountNumber":"A2","splitPercentage":"10","assignmentEffectiveDate":"2017-06-01","orgName":"OrgA"}`)
+}
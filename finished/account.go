@@ -0,0 +1,113 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Fields that updateAccount may not touch. policyPrefix and accountNumber
+// select the record; version is maintained by the chaincode.
+var accountImmutable = []string{"docType", "version"}
+
+// getAccount loads the account stored for policyPrefix and accountNumber.
+func getAccount(stub shim.ChaincodeStubInterface, policyPrefix, accountNumber string) (string, AccountStruct, error) {
+	var accStruct AccountStruct
+
+	key, err := accountKey(policyPrefix, accountNumber)
+	if err != nil {
+		return "", accStruct, err
+	}
+
+	err = getEntity(stub, accountDocType, key, &accStruct)
+	return key, accStruct, err
+}
+
+// storeAccount writes an account under key, replacing any existing record.
+func storeAccount(stub shim.ChaincodeStubInterface, key string, accStruct AccountStruct) error {
+	accStruct.ObjectType = accountDocType
+	accStructBytes, err := json.Marshal(accStruct)
+	if err != nil {
+		return err
+	}
+
+	return putEntity(stub, key, accStructBytes)
+}
+
+// updateAccount - invoke function to change some fields of an existing
+// account. args[0] is a JSON object holding policyPrefix, accountNumber and
+// the fields to change. The optional args[1] is the version the caller last
+// read; the update is rejected if the account has changed since. The
+// optional args[2] is the YYYY-MM-DD date the change takes effect,
+// defaulting to the transaction date.
+func (t *SimpleChaincode) updateAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	expected, checked, err := parseExpectedVersion(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	date, err := changeDate(stub, args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodePatch(args[0], accountImmutable)
+	if err != nil {
+		return nil, err
+	}
+	var status string
+	if json.Unmarshal(patch["accountStatus"], &status) == nil && strings.EqualFold(status, accountTerminated) {
+		return nil, newError(codeValidation, "Use terminateAccount to terminate an account").withField("accountStatus")
+	}
+	ids, err := patchKeyFields(patch, "policyPrefix", "accountNumber")
+	if err != nil {
+		return nil, err
+	}
+
+	key, head, err := getAccount(stub, ids[0], ids[1])
+	if err != nil {
+		return nil, err
+	}
+	var accStruct AccountStruct
+	ref := accountRef(ids[0], ids[1])
+	if err = baseVersion(stub, ref, head.AccountEffectiveDate, date, &accStruct); err != nil {
+		return nil, err
+	}
+	if err = checkVersion(key, accStruct.Version, expected, checked); err != nil {
+		return nil, err
+	}
+
+	if err = decodeStrict([]byte(args[0]), &accStruct); err != nil {
+		return nil, err
+	}
+	if err = validate(&accStruct, accountSchema); err != nil {
+		return nil, err
+	}
+
+	accStruct.Version++
+	pending, err := commitVersion(stub, ref, date, &accStruct)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("*** successfully updated account %s to version %d\n", key, accStruct.Version)
+
+	return changeMessage("Account", "updated", date, pending), nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fields that must be present and non-empty when creating each entity.
+var (
+	marketerRequired   = []string{"eId", "taxId", "legalName"}
+	accountRequired    = []string{"accountNumber", "policyPrefix"}
+	assignmentRequired = []string{"assignmentId", "ownerEId", "policyPrefix", "accountNumber", "eId", "assignmentEffectiveDate", "assignmentStatus"}
+)
+
+// decodeJSONArg unmarshals the single JSON argument of an invoke into v.
+// Fields that v does not declare are rejected, and the result must satisfy schema.
+func decodeJSONArg(args []string, v interface{}, schema recordSchema) error {
+	if len(args) != 1 {
+		return newError(codeBadRequest, "Incorrect number of arguments. Expecting 1 JSON object")
+	}
+
+	if err := decodeStrict([]byte(args[0]), v); err != nil {
+		return err
+	}
+	if err := rejectSealed(v); err != nil {
+		return err
+	}
+
+	return validate(v, schema)
+}
+
+// rejectSealed fails if any string field of the struct v points to holds a
+// sealed value. Only the chaincode seals values, so one arriving from a
+// caller is ciphertext or a mask it did not produce.
+func rejectSealed(v interface{}) error {
+	val := reflect.Indirect(reflect.ValueOf(v))
+	var sealed []string
+	for name, idx := range jsonFields(v) {
+		if field := val.Field(idx); field.Kind() == reflect.String && isSealed(field.String()) {
+			sealed = append(sealed, name)
+		}
+	}
+	if len(sealed) > 0 {
+		sort.Strings(sealed)
+		return fieldsError(sealed, "may not be a sealed value")
+	}
+
+	return nil
+}
+
+// decodeStrict unmarshals data into v and fails on any field name that does
+// not exactly match one of v's json tags.
+func decodeStrict(data []byte, v interface{}) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return errorf(codeBadRequest, "Invalid JSON argument: %s", err)
+	}
+
+	known := jsonFields(v)
+	var unknown []string
+	for name := range raw {
+		if _, ok := known[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fieldsError(unknown, "is not a known field")
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return errorf(codeBadRequest, "Invalid JSON argument: %s", err)
+	}
+
+	return nil
+}
+
+// jsonFields maps the json name of every field of the struct v points to onto its index.
+func jsonFields(v interface{}) map[string]int {
+	typ := reflect.Indirect(reflect.ValueOf(v)).Type()
+	fields := make(map[string]int, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = i
+	}
+
+	return fields
+}
+
+// checkArgCount guards the positional legacy functions against short argument lists.
+func checkArgCount(args []string, want int) error {
+	if len(args) != want {
+		return errorf(codeBadRequest, "Incorrect number of arguments. Expecting %d", want)
+	}
+
+	return nil
+}
+
+// decodePatch parses the JSON argument of a partial update and rejects it if
+// it tries to change any of the locked fields or sends a sealed value.
+func decodePatch(arg string, locked []string) (map[string]json.RawMessage, error) {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(arg), &patch); err != nil {
+		return nil, errorf(codeBadRequest, "Invalid JSON argument: %s", err)
+	}
+
+	var rejected []string
+	for _, name := range locked {
+		if _, ok := patch[name]; ok {
+			rejected = append(rejected, name)
+		}
+	}
+	if len(rejected) > 0 {
+		return nil, fieldsError(rejected, "cannot be updated")
+	}
+
+	var sealed []string
+	for name, raw := range patch {
+		var value string
+		if json.Unmarshal(raw, &value) == nil && isSealed(value) {
+			sealed = append(sealed, name)
+		}
+	}
+	if len(sealed) > 0 {
+		sort.Strings(sealed)
+		return nil, fieldsError(sealed, "may not be a sealed value")
+	}
+
+	return patch, nil
+}
+
+// patchKeyFields returns the string values of the fields that identify the
+// record a patch applies to, reporting every one that is missing.
+func patchKeyFields(patch map[string]json.RawMessage, names ...string) ([]string, error) {
+	values := make([]string, len(names))
+	var missing []string
+	for i, name := range names {
+		if err := json.Unmarshal(patch[name], &values[i]); err != nil || values[i] == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fieldsError(missing, "is required")
+	}
+
+	return values, nil
+}
+
+// parseExpectedVersion reads the optional expected-version argument at
+// args[idx]. ok is false when the caller did not supply one.
+func parseExpectedVersion(args []string, idx int) (version int, ok bool, err error) {
+	if len(args) <= idx || args[idx] == "" {
+		return 0, false, nil
+	}
+
+	version, err = strconv.Atoi(args[idx])
+	if err != nil || version < 0 {
+		return 0, false, errorf(codeBadRequest, "Expected version must be a non-negative integer, got %q", args[idx]).withField("expectedVersion")
+	}
+
+	return version, true, nil
+}
+
+// checkVersion fails when an expected version was supplied and the stored
+// record has since moved on.
+func checkVersion(key string, stored, expected int, ok bool) error {
+	if ok && stored != expected {
+		return errorf(codeConflict, "Version conflict: expected version %d, found %d", expected, stored).withKey(key)
+	}
+
+	return nil
+}
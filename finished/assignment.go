@@ -0,0 +1,236 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Fields that updateAssignment may not touch. assignmentId selects the
+// record; version is maintained by the chaincode.
+var assignmentImmutable = []string{"docType", "version"}
+
+// getAssignment loads the assignment stored for assignmentId.
+func getAssignment(stub shim.ChaincodeStubInterface, assignmentId string) (string, AssignmentStruct, error) {
+	var assignStruct AssignmentStruct
+
+	key, err := assignmentKey(assignmentId)
+	if err != nil {
+		return "", assignStruct, err
+	}
+
+	err = getEntity(stub, assignmentDocType, key, &assignStruct)
+	return key, assignStruct, err
+}
+
+// storeAssignment writes an assignment under key, replacing any existing
+// record, and keeps its marketer and account index entries in step.
+func storeAssignment(stub shim.ChaincodeStubInterface, key string, assignStruct AssignmentStruct) error {
+	var old *AssignmentStruct
+	oldBytes, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if oldBytes != nil {
+		old = new(AssignmentStruct)
+		if err = json.Unmarshal(oldBytes, old); err != nil {
+			return err
+		}
+	}
+
+	assignStruct.ObjectType = assignmentDocType
+	assignStructBytes, err := json.Marshal(assignStruct)
+	if err != nil {
+		return err
+	}
+	if err = putEntity(stub, key, assignStructBytes); err != nil {
+		return err
+	}
+
+	return reindexAssignment(stub, old, assignStruct)
+}
+
+// updateAssignment - invoke function to change some fields of an existing
+// assignment. args[0] is a JSON object holding the assignmentId and the
+// fields to change. The optional args[1] is the version the caller last read;
+// the update is rejected if the assignment has changed since. The optional
+// args[2] is the YYYY-MM-DD date the change takes effect, defaulting to the
+// transaction date.
+func (t *SimpleChaincode) updateAssignment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	expected, checked, err := parseExpectedVersion(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	date, err := changeDate(stub, args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodePatch(args[0], assignmentImmutable)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := patchKeyFields(patch, "assignmentId")
+	if err != nil {
+		return nil, err
+	}
+
+	key, head, err := getAssignment(stub, ids[0])
+	if err != nil {
+		return nil, err
+	}
+	var assignStruct AssignmentStruct
+	ref := assignmentRef(ids[0])
+	if err = baseVersion(stub, ref, head.AssignmentEffectiveDate, date, &assignStruct); err != nil {
+		return nil, err
+	}
+	if err = checkVersion(key, assignStruct.Version, expected, checked); err != nil {
+		return nil, err
+	}
+
+	if err = decodeStrict([]byte(args[0]), &assignStruct); err != nil {
+		return nil, err
+	}
+	if err = checkOrg(stub, key, head.OrgName, assignStruct.OrgName); err != nil {
+		return nil, err
+	}
+	if err = validate(&assignStruct, assignmentSchema); err != nil {
+		return nil, err
+	}
+	if assignmentRefsChanged(patch) {
+		if err = checkAssignmentRefs(stub, assignStruct); err != nil {
+			return nil, err
+		}
+	}
+	if err = checkSplits(stub, &assignStruct); err != nil {
+		return nil, err
+	}
+
+	assignStruct.Version++
+	pending, err := commitVersion(stub, ref, date, &assignStruct)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("*** successfully updated assignment %s to version %d\n", key, assignStruct.Version)
+
+	return changeMessage("Assignment", "updated", date, pending), nil
+}
+
+// expandedAssignment is the record returned by readAssignment in expanded
+// mode. A reference that no longer resolves is left out.
+type expandedAssignment struct {
+	AssignmentStruct
+	Marketer *MarketerStruct `json:"marketer,omitempty"`
+	Owner    *MarketerStruct `json:"owner,omitempty"`
+	Account  *AccountStruct  `json:"account,omitempty"`
+}
+
+func (t *SimpleChaincode) readAssignmentExpanded(stub shim.ChaincodeStubInterface, assignmentId string) ([]byte, error) {
+	key, assignStruct, err := getAssignment(stub, assignmentId)
+	if err != nil {
+		return nil, err
+	}
+
+	expanded := expandedAssignment{AssignmentStruct: assignStruct}
+	if _, mktrStruct, err := getMarketer(stub, assignStruct.EId); err == nil {
+		presentMarketer(stub, &mktrStruct)
+		expanded.Marketer = &mktrStruct
+	}
+	if _, ownerStruct, err := getMarketer(stub, assignStruct.OwnerEId); err == nil {
+		presentMarketer(stub, &ownerStruct)
+		expanded.Owner = &ownerStruct
+	}
+	if _, accStruct, err := getAccount(stub, assignStruct.PolicyPrefix, assignStruct.AccountNumber); err == nil {
+		expanded.Account = &accStruct
+	}
+
+	return json.Marshal(recordEnvelope{
+		Type:          assignmentDocType,
+		Key:           key,
+		SchemaVersion: schemaVersion,
+		Record:        expanded,
+	})
+}
+
+// denormalizedAssignmentFields are the marketer fields earlier versions of
+// the chaincode copied into every assignment.
+var denormalizedAssignmentFields = []string{
+	"taxId", "beginDate", "marketerTypeFlag", "marketerType", "marketerRole",
+	"marketerStatus", "legalName", "gender", "doB", "regStateName",
+	"marketerEffectiveDate", "marketerEndDate", "firstName", "lastName",
+	"eMail", "marketerEaRole",
+}
+
+// migrateAssignments - invoke function that strips the copied marketer
+// fields from every stored assignment. It can only run once; the ids of the
+// rewritten assignments are recorded under MIGRATION~assignments.
+func (t *SimpleChaincode) migrateAssignments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return runOnce(stub, "assignments", "Assignment migration", func() (interface{}, error) {
+		startKey, endKey, err := prefixRange(assignmentKeyType)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := scanKeys(stub, startKey, endKey)
+		if err != nil {
+			return nil, err
+		}
+
+		migrated := []string{}
+		for _, key := range keys {
+			valueBytes, err := stub.GetState(key)
+			if err != nil {
+				return nil, err
+			}
+
+			var fields map[string]json.RawMessage
+			if err = json.Unmarshal(valueBytes, &fields); err != nil {
+				return nil, errorf(codeInternal, "Corrupt record: %s", err).withKey(key)
+			}
+			stale := false
+			for _, name := range denormalizedAssignmentFields {
+				if _, ok := fields[name]; ok {
+					stale = true
+				}
+			}
+			if !stale {
+				continue
+			}
+
+			// Decoding into AssignmentStruct drops every field it no longer declares.
+			var assignStruct AssignmentStruct
+			if err = json.Unmarshal(valueBytes, &assignStruct); err != nil {
+				return nil, errorf(codeInternal, "Corrupt record: %s", err).withKey(key)
+			}
+			assignStructBytes, err := json.Marshal(assignStruct)
+			if err != nil {
+				return nil, err
+			}
+			if err = putEntity(stub, key, assignStructBytes); err != nil {
+				return nil, err
+			}
+			migrated = append(migrated, assignStruct.AssignmentId)
+		}
+
+		fmt.Printf("*** stripped marketer fields from %d assignments\n", len(migrated))
+
+		return migrated, nil
+	})
+}
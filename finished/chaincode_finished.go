@@ -14,8 +14,6 @@ limitations under the License.
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -24,8 +22,10 @@ import (
 type isval []byte
 
 type MarketerStruct struct {
+	ObjectType            string `json:"docType"`
 	EId                   string `json:"eId"`
 	TaxId                 string `json:"taxId"`
+	TaxIdHash             string `json:"taxIdHash,omitempty"`
 	BeginDate             string `json:"beginDate"`
 	MarketerTypeFlag      string `json:"marketerTypeFlag"`
 	MarketerType          string `json:"marketerType"`
@@ -51,6 +51,8 @@ type MarketerStruct struct {
 }
 
 type AccountStruct struct {
+	ObjectType                 string `json:"docType"`
+	Version                    int    `json:"version"`
 	AccountNumber              string `json:"accountNumber"`
 	PolicyPrefix               string `json:"policyPrefix"`
 	InternalAccountName        string `json:"internalAccountName"`
@@ -61,9 +63,15 @@ type AccountStruct struct {
 	MarketerProduct            string `json:"marketerProduct"`
 	DisclosureStatus           string `json:"disclosureStatus"`
 	DisclosureEffectiveDate    string `json:"disclosureEffectiveDate"`
+	OrgName                    string `json:"orgName,omitempty"`
 }
 
+// AssignmentStruct records only the relationship between a marketer, its
+// owner and an account. Marketer and account details are joined in at read
+// time by readAssignment's expanded mode.
 type AssignmentStruct struct {
+	ObjectType              string `json:"docType"`
+	Version                 int    `json:"version"`
 	AssignmentId            string `json:"assignmentId"`
 	AssignmentRoleType      string `json:"assignmentRoleType"`
 	SplitPercentage         string `json:"splitPercentage"`
@@ -77,22 +85,6 @@ type AssignmentStruct struct {
 	PolicyPrefix            string `json:"policyPrefix"`
 	AccountNumber           string `json:"accountNumber"`
 	EId                     string `json:"eId"`
-	TaxId                   string `json:"taxId"`
-	BeginDate               string `json:"beginDate"`
-	MarketerTypeFlag        string `json:"marketerTypeFlag"`
-	MarketerType            string `json:"marketerType"`
-	MarketerRole            string `json:"marketerRole"`
-	MarketerStatus          string `json:"marketerStatus"`
-	LegalName               string `json:"legalName"`
-	Gender                  string `json:"gender"`
-	DoB                     string `json:"doB"`
-	RegStateName            string `json:"regStateName"`
-	MarketerEffectiveDate   string `json:"marketerEffectiveDate"`
-	MarketerEndDate         string `json:"marketerEndDate"`
-	FirstName               string `json:"firstName"`
-	LastName                string `json:"lastName"`
-	EMail                   string `json:"eMail"`
-	MarketerEaRole          string `json:"marketerEaRole"`
 }
 
 // SimpleChaincode example simple Chaincode implementation
@@ -109,25 +101,52 @@ func main() {
 	}
 }
 
-// Init resets all the things
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+// Init resets all the things. args[1] is the hex SHA-256 fingerprint of the
+// key that seals marketer PII, which cannot be changed once set; see pii.go.
+// It is required because marketers, whose TaxId is sealed and hashed with
+// that key, cannot be written without it.
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
+	defer func() { err = toChaincodeError(err) }()
+
+	if len(args) != 2 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting 2: a value and the PII key fingerprint")
 	}
 
-	err := stub.PutState("hello_world", []byte(args[0]))
+	if err = setPIIFingerprint(stub, args[1]); err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState("hello_world", []byte(args[0]))
 
 	if err != nil {
 		return nil, err
 	}
+	if err = initTaxIdSalt(stub); err != nil {
+		return nil, err
+	}
 
 	return nil, nil
 }
 
 // Invoke isur entry point to invoke a chaincode function
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
+	defer func() { err = toChaincodeError(err) }()
+
 	fmt.Println("invoke is running " + function)
+	if err = authorizeInvoke(stub, function); err != nil {
+		return nil, err
+	}
 
+	cs := &changeStub{ChaincodeStubInterface: stub}
+	if payload, err = t.dispatchInvoke(cs, function, args); err != nil {
+		return nil, err
+	}
+
+	return payload, emitChanges(cs)
+}
+
+// dispatchInvoke runs the invoke function named function.
+func (t *SimpleChaincode) dispatchInvoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	// Handle different functions
 	if function == "init" {
 		return t.Init(stub, "init", args)
@@ -137,31 +156,103 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.account(stub, args)
 	} else if function == "assign" {
 		return t.assign(stub, args)
+	} else if function == "writeLegacy" {
+		return t.writeLegacy(stub, args)
+	} else if function == "accountLegacy" {
+		return t.accountLegacy(stub, args)
+	} else if function == "assignLegacy" {
+		return t.assignLegacy(stub, args)
+	} else if function == "migrateKeys" {
+		return t.migrateKeys(stub, args)
+	} else if function == "migrateAssignments" {
+		return t.migrateAssignments(stub, args)
+	} else if function == "updateMarketer" {
+		return t.updateMarketer(stub, args)
+	} else if _, ok := marketerTransitions[function]; ok {
+		return t.transitionMarketer(stub, function, args)
+	} else if function == "updateAccount" {
+		return t.updateAccount(stub, args)
+	} else if function == "updateAssignment" {
+		return t.updateAssignment(stub, args)
+	} else if function == "terminateAccount" {
+		return t.terminateAccount(stub, args)
+	} else if function == "deleteMarketer" {
+		return t.deleteMarketer(stub, args)
+	} else if function == "deleteAccount" {
+		return t.deleteAccount(stub, args)
+	} else if function == "rollForward" {
+		return t.rollForward(stub, args)
+	} else if function == "indexMarketers" {
+		return t.indexMarketers(stub, args)
+	} else if function == "hashTaxIdIndex" {
+		return t.hashTaxIdIndex(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function)
 
-	return nil, errors.New("Received unknown function invocation: " + function)
+	return nil, newError(codeBadRequest, "Received unknown function invocation: "+function).withField("function")
 }
 
 // Query is our entry point for queries
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
+	defer func() { err = toChaincodeError(err) }()
+
 	fmt.Println("query is running " + function)
+	if err = authorizeQuery(stub, function); err != nil {
+		return nil, err
+	}
 
 	// Handle different functions
 	if function == "read" { //read a variable
 		return t.read(stub, args)
+	} else if function == "readMarketer" {
+		return t.readMarketer(stub, args)
+	} else if function == "readAccount" {
+		return t.readAccount(stub, args)
+	} else if function == "readAssignment" {
+		return t.readAssignment(stub, args)
+	} else if function == "splitTable" {
+		return t.splitTable(stub, args)
+	} else if function == "asOf" {
+		return t.asOf(stub, args)
+	} else if function == "history" {
+		return t.history(stub, args)
+	} else if _, ok := marketerLookups[function]; ok {
+		return t.marketersBy(stub, function, args)
+	} else if function == "marketerByTaxId" {
+		return t.marketerByTaxId(stub, args)
+	} else if function == "listMarketers" {
+		return t.listMarketers(stub, args)
+	} else if function == "listAccounts" {
+		return t.listAccounts(stub, args)
+	} else if function == "listAssignments" {
+		return t.listAssignments(stub, args)
+	} else if function == "assignmentsByMarketer" {
+		return t.assignmentsByMarketer(stub, args)
+	} else if function == "assignmentsByAccount" {
+		return t.assignmentsByAccount(stub, args)
 	}
 
 	fmt.Println("query did not find func: " + function)
 
-	return nil, errors.New("Received unknown function query: " + function)
+	return nil, newError(codeBadRequest, "Received unknown function query: "+function).withField("function")
 }
 
-// write - invoke function to write key/value pair
+// write - invoke function to add a marketer from a JSON encoded MarketerStruct
 func (t *SimpleChaincode) write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var mktrStruct MarketerStruct
 
-	var key string
-	var err error
+	if err := decodeJSONArg(args, &mktrStruct, marketerSchema); err != nil {
+		return nil, err
+	}
+
+	return t.putMarketer(stub, mktrStruct)
+}
+
+// writeLegacy - invoke function to add a marketer from 24 positional arguments
+func (t *SimpleChaincode) writeLegacy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if err := checkArgCount(args, 24); err != nil {
+		return nil, err
+	}
 
 	mktrStruct := MarketerStruct{
 		EId:                   args[0],
@@ -190,27 +281,74 @@ func (t *SimpleChaincode) write(stub shim.ChaincodeStubInterface, args []string)
 		OrgName:               args[23],
 	}
 
-	mktrStructBytes, err := json.Marshal(mktrStruct)
-	_ = err //ignore errors
-	key = args[0]
-	//t.read(stub, args)
-	isval, err := t.read(stub, args)
+	if err := rejectSealed(&mktrStruct); err != nil {
+		return nil, err
+	}
+	if err := validate(&mktrStruct, marketerSchema); err != nil {
+		return nil, err
+	}
+
+	return t.putMarketer(stub, mktrStruct)
+}
+
+// putMarketer stores a new marketer under MARKETER~eId, rejecting duplicates
+func (t *SimpleChaincode) putMarketer(stub shim.ChaincodeStubInterface, mktrStruct MarketerStruct) ([]byte, error) {
+
+	key, err := marketerKey(mktrStruct.EId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkOrg(stub, key, mktrStruct.OrgName); err != nil {
+		return nil, err
+	}
+
+	if mktrStruct.MarketerStatus == "" {
+		mktrStruct.MarketerStatus = marketerActive
+	}
+
+	date, err := firstDate(stub, mktrStruct.MarketerEffectiveDate, mktrStruct.BeginDate)
+	if err != nil {
+		return nil, err
+	}
+
+	isval, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
 	if isval == nil {
-		stub.PutState(key, mktrStructBytes)
+		mktrStruct.ObjectType = marketerDocType
+		if err = storeMarketer(stub, key, mktrStruct); err != nil {
+			return nil, err
+		}
+		if err = recordVersion(stub, marketerRef(mktrStruct.EId), date, &mktrStruct); err != nil {
+			return nil, err
+		}
 		fmt.Println("*** successfully wrote marketer to state")
 	} else {
 		fmt.Println("****duplicate entry")
-		dupMktrArr := []byte("Marketer exists!")
-		return dupMktrArr, errors.New("duplicate entry")
+		return nil, newError(codeDuplicate, "Marketer exists").withKey(key)
 	}
 
 	return []byte("Marketer added succesfully!"), nil
 }
 
+// account - invoke function to add an account from a JSON encoded AccountStruct
 func (t *SimpleChaincode) account(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var accStruct AccountStruct
+
+	if err := decodeJSONArg(args, &accStruct, accountSchema); err != nil {
+		return nil, err
+	}
+
+	return t.putAccount(stub, accStruct)
+}
 
-	var key string
-	var err error
+// accountLegacy - invoke function to add an account from 10 positional arguments
+func (t *SimpleChaincode) accountLegacy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if err := checkArgCount(args, 10); err != nil {
+		return nil, err
+	}
 
 	accStruct := AccountStruct{
 		AccountNumber:              args[0],
@@ -225,19 +363,69 @@ func (t *SimpleChaincode) account(stub shim.ChaincodeStubInterface, args []strin
 		DisclosureEffectiveDate:    args[9],
 	}
 
-	accStructBytes, err := json.Marshal(accStruct)
-	_ = err //ignore errors
-	key = args[0]
-	stub.PutState(key, accStructBytes)
+	if err := validate(&accStruct, accountSchema); err != nil {
+		return nil, err
+	}
+
+	return t.putAccount(stub, accStruct)
+}
+
+// putAccount stores a new account under ACCOUNT~policyPrefix~accountNumber,
+// rejecting duplicates. Changes go through updateAccount.
+func (t *SimpleChaincode) putAccount(stub shim.ChaincodeStubInterface, accStruct AccountStruct) ([]byte, error) {
+
+	key, err := accountKey(accStruct.PolicyPrefix, accStruct.AccountNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	isval, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if isval != nil {
+		fmt.Println("****duplicate entry")
+		return nil, newError(codeDuplicate, "Account exists").withKey(key)
+	}
+
+	date, err := firstDate(stub, accStruct.AccountEffectiveDate)
+	if err != nil {
+		return nil, err
+	}
+
+	accStruct.ObjectType = accountDocType
+	accStruct.Version = 1
+	if err = storeAccount(stub, key, accStruct); err != nil {
+		return nil, err
+	}
+	if err = recordVersion(stub, accountRef(accStruct.PolicyPrefix, accStruct.AccountNumber), date, &accStruct); err != nil {
+		return nil, err
+	}
 	fmt.Println("*** successfully wrote account to state")
 
 	return []byte("Account added succesfully!"), nil
 }
 
+// assign - invoke function to add an assignment from a JSON encoded
+// AssignmentStruct. An assignmentStatus left out defaults to Active.
 func (t *SimpleChaincode) assign(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	assignStruct := AssignmentStruct{AssignmentStatus: assignmentActive}
 
-	var key string
-	var err error
+	if err := decodeJSONArg(args, &assignStruct, assignmentSchema); err != nil {
+		return nil, err
+	}
+
+	return t.putAssignment(stub, assignStruct)
+}
+
+// assignLegacy - invoke function to add an assignment from 29 positional
+// arguments. args[13] onwards repeat the marketer's own fields and are ignored;
+// the marketer record is the only copy kept. An empty args[4] status
+// defaults to Active.
+func (t *SimpleChaincode) assignLegacy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if err := checkArgCount(args, 29); err != nil {
+		return nil, err
+	}
 
 	assignStruct := AssignmentStruct{
 		AssignmentId:            args[0],
@@ -253,50 +441,90 @@ func (t *SimpleChaincode) assign(stub shim.ChaincodeStubInterface, args []string
 		PolicyPrefix:            args[10],
 		AccountNumber:           args[11],
 		EId:                     args[12],
-		TaxId:                   args[13],
-		BeginDate:               args[14],
-		MarketerTypeFlag:        args[15],
-		MarketerType:            args[16],
-		MarketerRole:            args[17],
-		MarketerStatus:          args[18],
-		LegalName:               args[19],
-		Gender:                  args[20],
-		DoB:                     args[21],
-		RegStateName:            args[22],
-		MarketerEffectiveDate:   args[23],
-		MarketerEndDate:         args[24],
-		FirstName:               args[25],
-		LastName:                args[26],
-		EMail:                   args[27],
-		MarketerEaRole:          args[28],
-	}
-
-	assignStructBytes, err := json.Marshal(assignStruct)
-	_ = err //ignore errors
-	key = args[0]
-
-	stub.PutState(key, assignStructBytes)
+	}
+	if assignStruct.AssignmentStatus == "" {
+		assignStruct.AssignmentStatus = assignmentActive
+	}
+
+	if err := rejectSealed(&assignStruct); err != nil {
+		return nil, err
+	}
+	if err := validate(&assignStruct, assignmentSchema); err != nil {
+		return nil, err
+	}
+
+	return t.putAssignment(stub, assignStruct)
+}
+
+// putAssignment stores a new assignment under ASSIGNMENT~assignmentId,
+// rejecting duplicates. Changes go through updateAssignment.
+func (t *SimpleChaincode) putAssignment(stub shim.ChaincodeStubInterface, assignStruct AssignmentStruct) ([]byte, error) {
+
+	key, err := assignmentKey(assignStruct.AssignmentId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkOrg(stub, key, assignStruct.OrgName); err != nil {
+		return nil, err
+	}
+
+	isval, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if isval != nil {
+		fmt.Println("****duplicate entry")
+		return nil, newError(codeDuplicate, "Assignment exists").withKey(key)
+	}
+
+	if err = checkAssignmentRefs(stub, assignStruct); err != nil {
+		return nil, err
+	}
+	if err = checkSplits(stub, &assignStruct); err != nil {
+		return nil, err
+	}
+
+	assignStruct.ObjectType = assignmentDocType
+	assignStruct.Version = 1
+	if err = storeAssignment(stub, key, assignStruct); err != nil {
+		return nil, err
+	}
+	if err = recordVersion(stub, assignmentRef(assignStruct.AssignmentId), assignStruct.AssignmentEffectiveDate, &assignStruct); err != nil {
+		return nil, err
+	}
 	fmt.Println("*** successfully wrote assignemt to state")
 
 	return []byte("Assignment added succesfully!"), nil
 }
 
-// read - query function to read key/value pair
+// read - query function to read key/value pair. A missing key reads as an
+// empty payload; a value that does not decode is an error. The CONFIG keys
+// hold the chaincode's own settings and cannot be read.
 func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var key, jsonResp string
-	var err error
+	if err := checkArgCount(args, 1); err != nil {
+		return nil, err
+	}
 
-	var retrievedStruct MarketerStruct
-	key = args[0]
+	key := args[0]
+	if keyType, _ := splitCompositeKey(key); keyType == configKeyType {
+		return nil, newError(codeForbidden, "Configuration keys cannot be read").withKey(key)
+	}
 	retrievedBytes, err := stub.GetState(key)
-	json.Unmarshal(retrievedBytes, &retrievedStruct)
-
-	fmt.Println("Retrieved struct: ", &retrievedStruct)
-
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, newError(codeInternal, "Failed to get state").withKey(key)
+	}
+	if retrievedBytes == nil {
+		return nil, nil
+	}
+	if err = checkStoredValue(key, retrievedBytes); err != nil {
+		return nil, err
+	}
+	if retrievedBytes, err = presentStoredValue(stub, key, retrievedBytes); err != nil {
+		return nil, err
 	}
 
+	fmt.Printf("Retrieved %d bytes for %s\n", len(retrievedBytes), key)
+
 	return retrievedBytes, nil
 }
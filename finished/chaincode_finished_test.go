@@ -0,0 +1,306 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// testPIIKey is the key the tests seal marketer PII with.
+var testPIIKey = bytes.Repeat([]byte{7}, piiKeySize)
+
+var errInjected = errors.New("injected state failure")
+
+// testStub adds to the MockStub what it does not provide: certificate
+// attributes, transaction metadata, timestamps and the events set.
+// Transactions start on 2017-07-14 and days moves them on. GetState and
+// PutState fail while failGet and failPut are set.
+type testStub struct {
+	*shim.MockStub
+	attrs    map[string]string
+	metadata []byte
+	txs      int64
+	days     int64
+	failGet  bool
+	failPut  bool
+	events   map[string][]byte
+}
+
+// newTestStub returns a chaincode and a stub it has been initialised on,
+// with PII sealing configured and the caller an admin holding the PII key.
+func newTestStub(t *testing.T) (*SimpleChaincode, *testStub) {
+	cc := new(SimpleChaincode)
+	stub := &testStub{
+		MockStub: shim.NewMockStub("finished", cc),
+		attrs:    map[string]string{roleAttribute: roleAdmin, identityAttribute: "tester"},
+		metadata: []byte(`{"piiKey":"` + base64.StdEncoding.EncodeToString(testPIIKey) + `"}`),
+	}
+
+	sum := sha256.Sum256(testPIIKey)
+	stub.startTransaction()
+	if _, err := cc.Init(stub, "init", []string{"hello", hex.EncodeToString(sum[:])}); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	return cc, stub
+}
+
+// startTransaction starts a transaction with its own ID and a timestamp a
+// second after the previous one's, and no events set.
+func (s *testStub) startTransaction() {
+	s.txs++
+	s.events = map[string][]byte{}
+	s.MockTransactionStart(fmt.Sprintf("tx%d", s.txs))
+}
+
+// invoke runs an invoke function in a transaction of its own.
+func (s *testStub) invoke(cc *SimpleChaincode, function string, args ...string) ([]byte, error) {
+	s.startTransaction()
+	return cc.Invoke(s, function, args)
+}
+
+// mustInvoke is invoke for calls that set up a test and may not fail.
+func (s *testStub) mustInvoke(t *testing.T, cc *SimpleChaincode, function string, args ...string) {
+	if _, err := s.invoke(cc, function, args...); err != nil {
+		t.Fatalf("%s %v failed: %v", function, args, err)
+	}
+}
+
+func (s *testStub) ReadCertAttribute(name string) ([]byte, error) {
+	value, ok := s.attrs[name]
+	if !ok {
+		return nil, errors.New("no attribute " + name)
+	}
+
+	return []byte(value), nil
+}
+
+func (s *testStub) GetCallerMetadata() ([]byte, error) {
+	return s.metadata, nil
+}
+
+func (s *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: 1500000000 + s.days*24*60*60 + s.txs}, nil
+}
+
+func (s *testStub) SetEvent(name string, payload []byte) error {
+	s.events[name] = payload
+	return nil
+}
+
+func (s *testStub) GetState(key string) ([]byte, error) {
+	if s.failGet {
+		return nil, errInjected
+	}
+
+	return s.MockStub.GetState(key)
+}
+
+func (s *testStub) PutState(key string, value []byte) error {
+	if s.failPut {
+		return errInjected
+	}
+
+	return s.MockStub.PutState(key, value)
+}
+
+const (
+	testMarketer   = `{"eId":"E1","taxId":"123-45-6789","legalName":"Ann Lee","marketerEffectiveDate":"2017-01-01"}`
+	testAccount    = `{"policyPrefix":"P","accountNumber":"A1","accountStatus":"Active","accountEffectiveDate":"2017-01-01"}`
+	testAssignment = `{"assignmentId":"S1","eId":"E1","ownerEId":"E1","policyPrefix":"P","accountNumber":"A1","splitPercentage":"100","assignmentEffectiveDate":"2017-06-01"}`
+)
+
+// setupRecords writes the first n of the test marketer, account and
+// assignment.
+func setupRecords(t *testing.T, cc *SimpleChaincode, stub *testStub, n int) {
+	calls := []struct{ function, arg string }{
+		{"write", testMarketer},
+		{"account", testAccount},
+		{"assign", testAssignment},
+	}
+	for _, c := range calls[:n] {
+		stub.mustInvoke(t, cc, c.function, c.arg)
+	}
+}
+
+func TestInitRequiresFingerprint(t *testing.T) {
+	cc := new(SimpleChaincode)
+	stub := shim.NewMockStub("finished", cc)
+
+	for _, args := range [][]string{{"hello"}, {"hello", "not-a-digest"}} {
+		stub.MockTransactionStart("init")
+		payload, err := cc.Init(stub, "init", args)
+		stub.MockTransactionEnd("init")
+		if errorCode(err) != codeBadRequest {
+			t.Errorf("Init %q: got %q, %v; want a %s error", args, payload, err, codeBadRequest)
+		}
+	}
+	for _, key := range []string{"hello_world", piiConfigKey, taxIdSaltKey} {
+		if value := stub.State[key]; value != nil {
+			t.Errorf("Init that failed stored %s = %q", key, value)
+		}
+	}
+}
+
+func TestTaxIdLookupWithoutSalt(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 1)
+
+	if _, err := cc.Query(stub, "marketerByTaxId", []string{"123456789"}); err != nil {
+		t.Fatalf("marketerByTaxId failed: %v", err)
+	}
+	delete(stub.State, taxIdSaltKey)
+	if payload, err := cc.Query(stub, "marketerByTaxId", []string{"123456789"}); errorCode(err) != codeInternal {
+		t.Errorf("marketerByTaxId without a salt: got %q, %v; want an %s error", payload, err, codeInternal)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	cc, stub := newTestStub(t)
+	stub.State["E1"] = []byte(testMarketer)
+	stub.State["A1"] = []byte(testAccount)
+
+	metadata := stub.metadata
+	stub.metadata = nil
+	if payload, err := stub.invoke(cc, "migrateKeys"); errorCode(err) != codeForbidden {
+		t.Errorf("migrateKeys without the piiKey: got %q, %v; want a %s error", payload, err, codeForbidden)
+	}
+	if stub.State["MIGRATION~keys"] != nil {
+		t.Error("migrateKeys without the piiKey recorded that it ran")
+	}
+
+	stub.metadata = metadata
+	payload, err := stub.invoke(cc, "migrateKeys")
+	if err != nil {
+		t.Fatalf("migrateKeys failed: %v", err)
+	}
+	if want := `{"migrated":["ACCOUNT~P~A1","MARKETER~E1"],"skipped":["hello_world"]}`; string(payload) != want {
+		t.Errorf("migrateKeys: got %s, want %s", payload, want)
+	}
+	if stub.State["E1"] != nil || stub.State["A1"] != nil {
+		t.Error("migrateKeys left the flat keys behind")
+	}
+	if stored := stub.State["MARKETER~E1"]; !bytes.Contains(stored, []byte(`"taxId":"enc:v1:***-**-6789:`)) {
+		t.Errorf("migrateKeys did not seal the TaxId: %s", stored)
+	}
+}
+
+func TestTimestampFailures(t *testing.T) {
+	// The MockStub has no transaction timestamp.
+	stub := shim.NewMockStub("finished", new(SimpleChaincode))
+	stub.MockTransactionStart("tx1")
+
+	if date, err := txDate(stub); errorCode(err) != codeInternal {
+		t.Errorf("txDate: got %q, %v; want an %s error", date, err, codeInternal)
+	}
+	if at, err := recordedAt(stub); errorCode(err) != codeInternal {
+		t.Errorf("recordedAt: got %q, %v; want an %s error", at, err, codeInternal)
+	}
+}
+
+func TestStateFailuresFailTheTransaction(t *testing.T) {
+	cases := []struct {
+		function string
+		arg      string
+		records  int // how many test records exist beforehand
+	}{
+		{"write", testMarketer, 0},
+		{"account", testAccount, 1},
+		{"assign", testAssignment, 2},
+		{"updateMarketer", `{"eId":"E1","legalName":"Ann Low"}`, 1},
+		{"updateAccount", `{"policyPrefix":"P","accountNumber":"A1","marketerProduct":"Term"}`, 2},
+		{"updateAssignment", `{"assignmentId":"S1","assignmentRoleType":"Primary"}`, 3},
+	}
+
+	for _, c := range cases {
+		for _, failure := range []string{"GetState", "PutState"} {
+			cc, stub := newTestStub(t)
+			setupRecords(t, cc, stub, c.records)
+			stub.failGet = failure == "GetState"
+			stub.failPut = failure == "PutState"
+
+			payload, err := stub.invoke(cc, c.function, c.arg)
+			if errorCode(err) != codeInternal {
+				t.Errorf("%s with failing %s: got %q, %v; want an %s error", c.function, failure, payload, err, codeInternal)
+			}
+		}
+	}
+}
+
+func TestStateFailuresSucceedWithoutInjection(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 3)
+
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E1","legalName":"Ann Low"}`)
+	stub.mustInvoke(t, cc, "updateAccount", `{"policyPrefix":"P","accountNumber":"A1","marketerProduct":"Term"}`)
+	stub.mustInvoke(t, cc, "updateAssignment", `{"assignmentId":"S1","assignmentRoleType":"Primary"}`)
+}
+
+func TestReadFailures(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 1)
+
+	stub.failGet = true
+	if payload, err := cc.Query(stub, "read", []string{"MARKETER~E1"}); errorCode(err) != codeInternal {
+		t.Errorf("read with failing GetState: got %q, %v; want an %s error", payload, err, codeInternal)
+	}
+	stub.failGet = false
+
+	stub.State["MARKETER~E2"] = []byte(`{"eId":`)
+	stub.State["NOTES~1"] = []byte(`{"note":`)
+	for _, key := range []string{"MARKETER~E2", "NOTES~1"} {
+		if payload, err := cc.Query(stub, "read", []string{key}); errorCode(err) != codeInternal {
+			t.Errorf("read of corrupt %s: got %q, %v; want an %s error", key, payload, err, codeInternal)
+		}
+	}
+
+	payload, err := cc.Query(stub, "read", []string{"hello_world"})
+	if err != nil || string(payload) != "hello" {
+		t.Errorf("read of a plain value: got %q, %v; want %q", payload, err, "hello")
+	}
+	payload, err = cc.Query(stub, "read", []string{"MARKETER~E9"})
+	if err != nil || payload != nil {
+		t.Errorf("read of a missing key: got %q, %v; want an empty payload", payload, err)
+	}
+}
+
+func TestUpdatesRejectCorruptRecords(t *testing.T) {
+	cases := []struct {
+		function, arg, key string
+	}{
+		{"updateMarketer", `{"eId":"E1","legalName":"Ann Low"}`, "MARKETER~E1"},
+		{"updateAccount", `{"policyPrefix":"P","accountNumber":"A1","marketerProduct":"Term"}`, "ACCOUNT~P~A1"},
+		{"updateAssignment", `{"assignmentId":"S1","assignmentRoleType":"Primary"}`, "ASSIGNMENT~S1"},
+	}
+
+	for _, c := range cases {
+		cc, stub := newTestStub(t)
+		setupRecords(t, cc, stub, 3)
+		stub.State[c.key] = []byte(`{"docType":`)
+
+		payload, err := stub.invoke(cc, c.function, c.arg)
+		if errorCode(err) != codeInternal {
+			t.Errorf("%s of corrupt %s: got %q, %v; want an %s error", c.function, c.key, payload, err, codeInternal)
+		}
+	}
+}
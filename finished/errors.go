@@ -0,0 +1,97 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Error codes returned to clients. Clients should branch on these rather
+// than on the message text.
+const (
+	codeBadRequest = "BAD_REQUEST" // malformed arguments or unknown function
+	codeNotFound   = "NOT_FOUND"   // the addressed record does not exist
+	codeDuplicate  = "DUPLICATE"   // a record or unique value already exists
+	codeValidation = "VALIDATION"  // a record or argument breaks a field rule
+	codeConflict   = "CONFLICT"    // the ledger state does not allow the change
+	codeForbidden  = "FORBIDDEN"   // the caller may not perform the operation
+	codeInternal   = "INTERNAL"    // state access failed or a record is corrupt
+)
+
+// chaincodeError is the single error model of every invoke and query. Its
+// Error method returns the JSON encoding, which is what the client sees.
+type chaincodeError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Field   string      `json:"field,omitempty"`
+	Key     string      `json:"key,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *chaincodeError) Error() string {
+	errBytes, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Sprintf(`{"code":%q,"message":%q}`, e.Code, e.Message)
+	}
+
+	return string(errBytes)
+}
+
+func newError(code, message string) *chaincodeError {
+	return &chaincodeError{Code: code, Message: message}
+}
+
+func errorf(code, format string, a ...interface{}) *chaincodeError {
+	return newError(code, fmt.Sprintf(format, a...))
+}
+
+// withField names the argument or record field the error is about.
+func (e *chaincodeError) withField(field string) *chaincodeError {
+	e.Field = field
+	return e
+}
+
+// withKey names the ledger key the error is about.
+func (e *chaincodeError) withKey(key string) *chaincodeError {
+	e.Key = key
+	return e
+}
+
+func (e *chaincodeError) withDetails(details interface{}) *chaincodeError {
+	e.Details = details
+	return e
+}
+
+// errorCode returns the code of err, or "" when it is not a chaincodeError.
+func errorCode(err error) string {
+	if e, ok := err.(*chaincodeError); ok {
+		return e.Code
+	}
+
+	return ""
+}
+
+// toChaincodeError passes chaincodeErrors through and reports any other
+// error, typically from the shim, as INTERNAL.
+func toChaincodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*chaincodeError); ok {
+		return err
+	}
+
+	return newError(codeInternal, err.Error())
+}
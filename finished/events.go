@@ -0,0 +1,220 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// A transaction may set only one chaincode event, so every change putEntity
+// and delEntity make to an entity's head is collected for the transaction
+// and Invoke emits them together as a single entityChanges event once the
+// function succeeds. A change dated in the future leaves the head alone
+// until rollForward applies it, so it is in rollForward's event. The payload
+// schema is documented in docs/events.md. Events name the fields that
+// changed but never carry their values.
+const (
+	changeEventName   = "entityChanges"
+	changeEventSchema = "entityChanges/v1"
+
+	changeCreate = "create"
+	changeUpdate = "update"
+	changeStatus = "statusChange"
+	changeDelete = "delete"
+)
+
+// statusFields names the status field of each docType; a change to it makes
+// the change a statusChange.
+var statusFields = map[string]string{
+	marketerDocType:   "marketerStatus",
+	accountDocType:    "accountStatus",
+	assignmentDocType: "assignmentStatus",
+}
+
+// entityChange describes the net change of one entity in a transaction.
+type entityChange struct {
+	Type          string   `json:"type"`
+	Key           string   `json:"key"`
+	Change        string   `json:"change"`
+	ChangedFields []string `json:"changedFields"`
+}
+
+// changeEvent is the payload of the entityChanges event.
+type changeEvent struct {
+	Schema    string          `json:"schema"`
+	TxID      string          `json:"txId"`
+	Timestamp string          `json:"timestamp"`
+	Changes   []*entityChange `json:"changes"`
+}
+
+// changeStub is the stub Invoke hands to the invoke functions. It collects
+// the changes of the transaction until Invoke emits them.
+type changeStub struct {
+	shim.ChaincodeStubInterface
+	changes []*entityChange
+}
+
+// changedFields returns the sorted names of the top-level fields that differ
+// between two JSON records, either of which may be nil, and their docType.
+func changedFields(oldBytes, newBytes []byte) ([]string, string, error) {
+	var oldFields, newFields map[string]interface{}
+	if oldBytes != nil {
+		if err := json.Unmarshal(oldBytes, &oldFields); err != nil {
+			return nil, "", err
+		}
+	}
+	if newBytes != nil {
+		if err := json.Unmarshal(newBytes, &newFields); err != nil {
+			return nil, "", err
+		}
+	}
+
+	docType, _ := newFields["docType"].(string)
+	if docType == "" {
+		docType, _ = oldFields["docType"].(string)
+	}
+
+	// A field absent on one side counts as empty, so a create names only the
+	// fields it sets.
+	fields := []string{}
+	for name, value := range newFields {
+		old, ok := oldFields[name]
+		if ok && !reflect.DeepEqual(old, value) || !ok && !isEmptyJSON(value) {
+			fields = append(fields, name)
+		}
+	}
+	for name, old := range oldFields {
+		if _, ok := newFields[name]; !ok && !isEmptyJSON(old) {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+
+	return fields, docType, nil
+}
+
+// isEmptyJSON reports whether a decoded JSON value is null or its type's
+// zero value.
+func isEmptyJSON(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	}
+
+	return false
+}
+
+// noteChange records the change of the head stored under key from oldBytes
+// to newBytes, either of which is nil for a create or a delete. Changes made
+// through a stub other than Invoke's changeStub are not recorded.
+func noteChange(stub shim.ChaincodeStubInterface, key string, oldBytes, newBytes []byte) error {
+	cs, ok := stub.(*changeStub)
+	if !ok {
+		return nil
+	}
+	fields, docType, err := changedFields(oldBytes, newBytes)
+	if err != nil {
+		return errorf(codeInternal, "Corrupt record: %s", err).withKey(key)
+	}
+
+	change := changeUpdate
+	switch {
+	case oldBytes == nil:
+		change = changeCreate
+	case newBytes == nil:
+		change, fields = changeDelete, []string{}
+	case len(fields) == 0:
+		return nil
+	}
+	if change == changeUpdate {
+		for _, field := range fields {
+			if field == statusFields[docType] {
+				change = changeStatus
+			}
+		}
+	}
+
+	for i, prior := range cs.changes {
+		if prior.Key != key {
+			continue
+		}
+		switch {
+		case prior.Change == changeCreate && change == changeDelete:
+			cs.changes = append(cs.changes[:i], cs.changes[i+1:]...)
+		case change == changeDelete:
+			prior.Change, prior.ChangedFields = changeDelete, []string{}
+		case prior.Change == changeDelete:
+			prior.Change, prior.ChangedFields = changeUpdate, fields
+		default:
+			if prior.Change == changeUpdate {
+				prior.Change = change
+			}
+			prior.ChangedFields = mergeFields(prior.ChangedFields, fields)
+		}
+		return nil
+	}
+
+	cs.changes = append(cs.changes, &entityChange{docType, key, change, fields})
+	return nil
+}
+
+// mergeFields returns the sorted union of two sorted field lists.
+func mergeFields(a, b []string) []string {
+	seen := map[string]bool{}
+	merged := []string{}
+	for _, field := range append(append([]string{}, a...), b...) {
+		if !seen[field] {
+			seen[field] = true
+			merged = append(merged, field)
+		}
+	}
+	sort.Strings(merged)
+
+	return merged
+}
+
+// emitChanges sets the entityChanges event for the changes collected in the
+// transaction, if there are any.
+func emitChanges(cs *changeStub) error {
+	if len(cs.changes) == 0 {
+		return nil
+	}
+
+	ts, err := cs.GetTxTimestamp()
+	if err != nil || ts == nil {
+		return newError(codeInternal, "Transaction timestamp unavailable")
+	}
+	payload, err := json.Marshal(changeEvent{
+		Schema:    changeEventSchema,
+		TxID:      cs.GetTxID(),
+		Timestamp: time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339Nano),
+		Changes:   cs.changes,
+	})
+	if err != nil {
+		return err
+	}
+
+	return cs.SetEvent(changeEventName, payload)
+}
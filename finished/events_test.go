@@ -0,0 +1,154 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// lastChanges returns the changes of the entityChanges event set by the
+// last transaction, nil if it set none.
+func lastChanges(t *testing.T, stub *testStub) []*entityChange {
+	payload, ok := stub.events[changeEventName]
+	if !ok {
+		return nil
+	}
+	var event changeEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatalf("entityChanges event %s: %v", payload, err)
+	}
+	if event.Schema != changeEventSchema || event.TxID != stub.GetTxID() || len(event.Changes) == 0 {
+		t.Errorf("entityChanges event of %s: got %s", stub.GetTxID(), payload)
+	}
+
+	return event.Changes
+}
+
+// hasField reports whether field is one of the changed fields.
+func hasField(change *entityChange, field string) bool {
+	for _, name := range change.ChangedFields {
+		if name == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestChangeEvents(t *testing.T) {
+	cc, stub := newTestStub(t)
+
+	setupRecords(t, cc, stub, 1)
+	payload := stub.events[changeEventName]
+	if want := `{"schema":"entityChanges/v1","txId":"tx2","timestamp":"2017-07-14T02:40:02Z","changes":[{"type":"marketer","key":"MARKETER~E1","change":"create","changedFields":[`; !strings.HasPrefix(string(payload), want) {
+		t.Errorf("event of write: got %s, want it to start %s", payload, want)
+	}
+	changes := lastChanges(t, stub)
+	if !hasField(changes[0], "legalName") || !hasField(changes[0], "taxId") || hasField(changes[0], "marketerEndDate") {
+		t.Errorf("create fields: got %q, want the fields set", changes[0].ChangedFields)
+	}
+	for _, value := range []string{"Ann Lee", "6789"} {
+		if strings.Contains(string(payload), value) {
+			t.Errorf("event of write carries the value %q: %s", value, payload)
+		}
+	}
+
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E1","legalName":"Ann Lim"}`)
+	changes = lastChanges(t, stub)
+	if len(changes) != 1 || changes[0].Change != changeUpdate || !hasField(changes[0], "legalName") || hasField(changes[0], "taxId") {
+		t.Errorf("event of updateMarketer: got %+v, want an update of legalName", changes)
+	}
+
+	if _, err := stub.invoke(cc, "write", testMarketer); err == nil || stub.events[changeEventName] != nil {
+		t.Errorf("failed write: got %v and the event %s; want an error and no event", err, stub.events[changeEventName])
+	}
+
+	stub.mustInvoke(t, cc, "account", testAccount)
+	stub.mustInvoke(t, cc, "assign", testAssignment)
+	stub.mustInvoke(t, cc, "terminateMarketer", "E1", "2017-07-14", "cascade")
+	changes = lastChanges(t, stub)
+	if len(changes) != 2 {
+		t.Fatalf("event of a cascading terminateMarketer: got %+v, want the marketer and S1", changes)
+	}
+	for _, change := range changes {
+		if change.Change != changeStatus || change.Key != "MARKETER~E1" && change.Key != "ASSIGNMENT~S1" {
+			t.Errorf("event of a cascading terminateMarketer: got %+v, want status changes of the marketer and S1", change)
+		}
+	}
+
+	stub.mustInvoke(t, cc, "deleteMarketer", "E1", "cascade")
+	changes = lastChanges(t, stub)
+	for _, change := range changes {
+		if change.Change != changeDelete || len(change.ChangedFields) != 0 {
+			t.Errorf("event of a cascading deleteMarketer: got %+v, want deletes", change)
+		}
+	}
+}
+
+func TestFutureDatedChangeEvents(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 1)
+
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E1","legalName":"Ann Lane"}`, "2017-08-01")
+	if changes := lastChanges(t, stub); changes != nil {
+		t.Errorf("event of a future-dated update: got %+v, want none", changes)
+	}
+
+	stub.days = 19
+	stub.mustInvoke(t, cc, "rollForward")
+	changes := lastChanges(t, stub)
+	if len(changes) != 1 || changes[0].Key != "MARKETER~E1" || changes[0].Change != changeUpdate || !hasField(changes[0], "legalName") {
+		t.Errorf("event of rollForward: got %+v, want the update of E1", changes)
+	}
+}
+
+func TestChangesNetOut(t *testing.T) {
+	_, stub := newTestStub(t)
+	stub.startTransaction()
+	cs := &changeStub{ChaincodeStubInterface: stub}
+
+	// A record created and deleted in one transaction is left out.
+	for _, record := range []string{
+		`{"docType":"account","accountStatus":"Active"}`,
+		`{"docType":"account","accountStatus":"Active","marketerProduct":"Term"}`,
+	} {
+		if err := putEntity(cs, "ACCOUNT~P~A1", []byte(record)); err != nil {
+			t.Fatalf("writing %s failed: %v", record, err)
+		}
+		if len(cs.changes) != 1 || cs.changes[0].Change != changeCreate {
+			t.Errorf("after writing %s: got %+v, want a create", record, cs.changes)
+		}
+	}
+	if err := delEntity(cs, "ACCOUNT~P~A1"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if len(cs.changes) != 0 {
+		t.Errorf("after deleting a record created in the transaction: got %+v, want no changes", cs.changes)
+	}
+
+	stub.State["ACCOUNT~P~A2"] = []byte(`{"docType":"account","accountStatus":"Active"}`)
+	for _, record := range []string{
+		`{"docType":"account","accountStatus":"Active","marketerProduct":"Term"}`,
+		`{"docType":"account","accountStatus":"Terminated","marketerProduct":"Term"}`,
+	} {
+		if err := putEntity(cs, "ACCOUNT~P~A2", []byte(record)); err != nil {
+			t.Fatalf("writing %s failed: %v", record, err)
+		}
+	}
+	if len(cs.changes) != 1 || cs.changes[0].Change != changeStatus || strings.Join(cs.changes[0].ChangedFields, ",") != "accountStatus,marketerProduct" {
+		t.Errorf("after an update and a status change: got %+v, want one statusChange of both fields", cs.changes[0])
+	}
+}
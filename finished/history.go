@@ -0,0 +1,199 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// The v0.6 shim has no key history, so every write or delete of an entity's
+// head record is also appended under
+//
+//	HISTORY~<TYPE>~<ids...>~<recordedAt>
+//
+// Entries are never updated or removed. A transaction touching the same
+// entity more than once leaves a single entry holding its final state.
+const (
+	historyKeyType = "HISTORY"
+
+	historyPut    = "put"
+	historyDelete = "delete"
+
+	// identityAttribute is the enrollment certificate attribute naming the submitter.
+	identityAttribute = "enrollmentId"
+)
+
+// historyEntry is the change log entry stored for one transaction.
+type historyEntry struct {
+	TxID      string          `json:"txId"`
+	Timestamp string          `json:"timestamp"`
+	Identity  string          `json:"identity"`
+	Action    string          `json:"action"`
+	Record    json.RawMessage `json:"record,omitempty"`
+}
+
+// callerIdentity names the submitter of the transaction: its enrollment ID
+// when the certificate carries one, otherwise a digest of the certificate.
+func callerIdentity(stub shim.ChaincodeStubInterface) string {
+	if attr, err := stub.ReadCertAttribute(identityAttribute); err == nil && len(attr) > 0 {
+		return string(attr)
+	}
+	if cert, err := stub.GetCallerCertificate(); err == nil && len(cert) > 0 {
+		sum := sha256.Sum256(cert)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	return "unknown"
+}
+
+// historyPrefix returns the HISTORY key attributes for an entity key.
+func historyPrefix(key string) []string {
+	keyType, ids := splitCompositeKey(key)
+	return append([]string{keyType}, ids...)
+}
+
+// logChange appends the change log entry for the entity stored under key.
+// recordBytes is the record as written, or nil for a delete.
+func logChange(stub shim.ChaincodeStubInterface, key, action string, recordBytes []byte) error {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil || ts == nil {
+		return newError(codeInternal, "Transaction timestamp unavailable")
+	}
+	stamp, err := recordedAt(stub)
+	if err != nil {
+		return err
+	}
+
+	historyKey, err := compositeKey(historyKeyType, append(historyPrefix(key), stamp)...)
+	if err != nil {
+		return err
+	}
+	entryBytes, err := json.Marshal(historyEntry{
+		TxID:      stub.GetTxID(),
+		Timestamp: time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339Nano),
+		Identity:  callerIdentity(stub),
+		Action:    action,
+		Record:    recordBytes,
+	})
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(historyKey, entryBytes)
+}
+
+// putEntity writes an entity's head record, logs the change and notes it
+// for the transaction's change event.
+func putEntity(stub shim.ChaincodeStubInterface, key string, recordBytes []byte) error {
+	oldBytes, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if err = stub.PutState(key, recordBytes); err != nil {
+		return err
+	}
+	if err = noteChange(stub, key, oldBytes, recordBytes); err != nil {
+		return err
+	}
+
+	return logChange(stub, key, historyPut, recordBytes)
+}
+
+// delEntity deletes an entity's head record, logs the change and notes it
+// for the transaction's change event.
+func delEntity(stub shim.ChaincodeStubInterface, key string) error {
+	oldBytes, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if err = stub.DelState(key); err != nil {
+		return err
+	}
+	if oldBytes != nil {
+		if err = noteChange(stub, key, oldBytes, nil); err != nil {
+			return err
+		}
+	}
+
+	return logChange(stub, key, historyDelete, nil)
+}
+
+// history - query function returning the change log of an entity, oldest
+// first, with each record decoded into its entity type. args are the type
+// (marketer, account or assignment) and the entity's ids.
+func (t *SimpleChaincode) history(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 2 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting type and ids")
+	}
+
+	ref := entityRef{args[0], args[1:]}
+	key, err := ref.key()
+	if err != nil {
+		return nil, err
+	}
+	startKey, endKey, err := prefixRange(historyKeyType, historyPrefix(key)...)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	type decodedEntry struct {
+		TxID      string      `json:"txId"`
+		Timestamp string      `json:"timestamp"`
+		Identity  string      `json:"identity"`
+		Action    string      `json:"action"`
+		Record    interface{} `json:"record,omitempty"`
+	}
+	entries := []decodedEntry{}
+	for iter.HasNext() {
+		historyKey, value, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var entry historyEntry
+		if err = json.Unmarshal(value, &entry); err != nil {
+			return nil, errorf(codeInternal, "Corrupt history entry: %s", err).withKey(historyKey)
+		}
+		decoded := decodedEntry{entry.TxID, entry.Timestamp, entry.Identity, entry.Action, nil}
+		if entry.Record != nil {
+			record := ref.newRecord()
+			if err = json.Unmarshal(entry.Record, record); err != nil {
+				return nil, errorf(codeInternal, "Corrupt history entry: %s", err).withKey(historyKey)
+			}
+			if err = openRecord(stub, record); err != nil {
+				return nil, err
+			}
+			presentRecord(stub, record)
+			decoded.Record = record
+		}
+		entries = append(entries, decoded)
+	}
+
+	return json.Marshal(struct {
+		Type    string         `json:"type"`
+		Key     string         `json:"key"`
+		History []decodedEntry `json:"history"`
+	}{ref.docType, key, entries})
+}
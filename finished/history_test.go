@@ -0,0 +1,118 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testHistoryEntry is a history entry with the marketer fields the tests check.
+type testHistoryEntry struct {
+	TxID      string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+	Identity  string `json:"identity"`
+	Action    string `json:"action"`
+	Record    *struct {
+		LegalName string `json:"legalName"`
+		TaxId     string `json:"taxId"`
+	} `json:"record"`
+}
+
+func TestHistory(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 1)
+	stub.attrs[identityAttribute] = "other"
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E1","legalName":"Ann Lim"}`)
+	stub.mustInvoke(t, cc, "deleteMarketer", "E1")
+	stub.mustInvoke(t, cc, "write", testPIIMarketer)
+
+	payload, err := cc.Query(stub, "history", []string{"marketer", "E1"})
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	var result struct {
+		Type    string             `json:"type"`
+		Key     string             `json:"key"`
+		History []testHistoryEntry `json:"history"`
+	}
+	if err = json.Unmarshal(payload, &result); err != nil {
+		t.Fatalf("history returned %s: %v", payload, err)
+	}
+	if result.Type != "marketer" || result.Key != "MARKETER~E1" || len(result.History) != 3 {
+		t.Fatalf("history of E1: got %s, want its 3 changes", payload)
+	}
+
+	for i, want := range []struct{ txID, timestamp, identity, action, legalName string }{
+		{"tx2", "2017-07-14T02:40:02Z", "tester", historyPut, "Ann Lee"},
+		{"tx3", "2017-07-14T02:40:03Z", "other", historyPut, "Ann Lim"},
+		{"tx4", "2017-07-14T02:40:04Z", "other", historyDelete, ""},
+	} {
+		got := result.History[i]
+		if got.TxID != want.txID || got.Timestamp != want.timestamp || got.Identity != want.identity || got.Action != want.action {
+			t.Errorf("history entry %d: got %+v, want %+v", i, got, want)
+		}
+		if want.action == historyDelete {
+			if got.Record != nil {
+				t.Errorf("history entry %d of a delete holds a record", i)
+			}
+			continue
+		}
+		if got.Record == nil || got.Record.LegalName != want.legalName || got.Record.TaxId != "123-45-6789" {
+			t.Errorf("history entry %d: got record %+v, want %s with its TaxId opened", i, got.Record, want.legalName)
+		}
+	}
+
+	stub.metadata = nil
+	payload, err = cc.Query(stub, "history", []string{"marketer", "E1"})
+	if err != nil {
+		t.Fatalf("history without the piiKey failed: %v", err)
+	}
+	if err = json.Unmarshal(payload, &result); err != nil || result.History[0].Record.TaxId != "***-**-6789" {
+		t.Errorf("history without the piiKey: got %s, want the TaxId masked", payload)
+	}
+
+	for _, args := range [][]string{{"marketer"}, {"policy", "E1"}} {
+		if payload, err := cc.Query(stub, "history", args); errorCode(err) != codeBadRequest {
+			t.Errorf("history %q: got %q, %v; want a %s error", args, payload, err, codeBadRequest)
+		}
+	}
+}
+
+func TestHistoryKeepsOneEntryPerTransaction(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 1)
+
+	stub.startTransaction()
+	for _, legalName := range []string{"Ann Lim", "Ann Lin"} {
+		if _, err := cc.Invoke(stub, "updateMarketer", []string{`{"eId":"E1","legalName":"` + legalName + `"}`}); err != nil {
+			t.Fatalf("updateMarketer to %s failed: %v", legalName, err)
+		}
+	}
+
+	keys := keysWithPrefix(stub, "HISTORY~MARKETER~E1~")
+	if len(keys) != 2 {
+		t.Fatalf("history keys of E1: got %q, want one for the write and one for the updates", keys)
+	}
+	sort.Strings(keys)
+	var entry historyEntry
+	if err := json.Unmarshal(stub.State[keys[1]], &entry); err != nil {
+		t.Fatalf("corrupt history entry: %v", err)
+	}
+	if !strings.Contains(string(entry.Record), `"legalName":"Ann Lin"`) {
+		t.Errorf("history entry of the updates: got %s, want the final legalName", entry.Record)
+	}
+}
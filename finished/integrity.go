@@ -0,0 +1,477 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// AccountStatus and AssignmentStatus values the integrity checks rely on.
+const (
+	accountActive     = "Active"
+	accountTerminated = "Terminated"
+
+	assignmentActive     = "Active"
+	assignmentTerminated = "Terminated"
+)
+
+// What to do with the active assignments of a marketer or account that is
+// being terminated or deleted: refuse (the default) or terminate/delete them too.
+const (
+	policyBlock   = "block"
+	policyCascade = "cascade"
+)
+
+func parseReferencePolicy(args []string, idx int) (string, error) {
+	if len(args) <= idx || args[idx] == "" {
+		return policyBlock, nil
+	}
+	if args[idx] != policyBlock && args[idx] != policyCascade {
+		return "", errorf(codeBadRequest, "Reference policy must be %q or %q, got %q", policyBlock, policyCascade, args[idx]).withField("policy")
+	}
+
+	return args[idx], nil
+}
+
+// onOrBefore reports whether the YYYY-MM-DD date a is not after b. An empty
+// a counts as open-ended in the past.
+func onOrBefore(a, b string) bool {
+	return a == "" || a <= b
+}
+
+// marketerActiveOn reports whether a marketer is Active on date. The status
+// must have taken effect on or before date and the marketer may not have
+// ended by then.
+func marketerActiveOn(mktrStruct MarketerStruct, date string) bool {
+	return strings.EqualFold(mktrStruct.MarketerStatus, marketerActive) &&
+		onOrBefore(mktrStruct.MarketerEffectiveDate, date) &&
+		(mktrStruct.MarketerEndDate == "" || date < mktrStruct.MarketerEndDate)
+}
+
+// accountActiveOn reports whether an account is Active and in effect on date.
+func accountActiveOn(accStruct AccountStruct, date string) bool {
+	return strings.EqualFold(accStruct.AccountStatus, accountActive) &&
+		onOrBefore(accStruct.AccountEffectiveDate, date) &&
+		onOrBefore(accStruct.AccountStatusEffectiveDate, date)
+}
+
+// assignmentActiveOn reports whether an assignment is Active and has not ended by date.
+func assignmentActiveOn(assignStruct AssignmentStruct, date string) bool {
+	return strings.EqualFold(assignStruct.AssignmentStatus, assignmentActive) &&
+		(assignStruct.AssignmentEndDate == "" || date < assignStruct.AssignmentEndDate)
+}
+
+// checkAssignmentRefs verifies that the marketer, the owner marketer and the
+// account an assignment points at all exist and that a writer's org owns
+// them; an account without an orgName is shared by every org. For an Active
+// assignment they must also be active in the versions in effect on the
+// assignment's effective date.
+func checkAssignmentRefs(stub shim.ChaincodeStubInterface, assignStruct AssignmentStruct) error {
+	date := assignStruct.AssignmentEffectiveDate
+	if _, err := parseDate("assignmentEffectiveDate", date); err != nil {
+		return err
+	}
+	active := strings.EqualFold(assignStruct.AssignmentStatus, assignmentActive)
+
+	for _, ref := range []struct{ field, eId string }{
+		{"eId", assignStruct.EId},
+		{"ownerEId", assignStruct.OwnerEId},
+	} {
+		key, head, err := getMarketer(stub, ref.eId)
+		if errorCode(err) == codeNotFound {
+			return errorf(codeValidation, "Assignment %s: %s %s does not exist", assignStruct.AssignmentId, ref.field, ref.eId).withField(ref.field).withKey(key)
+		} else if err != nil {
+			return err
+		}
+		if err = checkOrg(stub, key, head.OrgName); err != nil {
+			return err
+		}
+		if !active {
+			continue
+		}
+		var mktrStruct MarketerStruct
+		found, err := versionAsOf(stub, marketerRef(ref.eId), date, &mktrStruct)
+		if err != nil {
+			return err
+		}
+		if !found || !marketerActiveOn(mktrStruct, date) {
+			return errorf(codeValidation, "Assignment %s: %s %s is not active on %s", assignStruct.AssignmentId, ref.field, ref.eId, date).withField(ref.field).withKey(key)
+		}
+	}
+
+	key, account, err := getAccount(stub, assignStruct.PolicyPrefix, assignStruct.AccountNumber)
+	if errorCode(err) == codeNotFound {
+		return errorf(codeValidation, "Assignment %s: account %s %s does not exist", assignStruct.AssignmentId, assignStruct.PolicyPrefix, assignStruct.AccountNumber).withField("accountNumber").withKey(key)
+	} else if err != nil {
+		return err
+	}
+	if account.OrgName != "" {
+		if err = checkOrg(stub, key, account.OrgName); err != nil {
+			return err
+		}
+	}
+	if !active {
+		return nil
+	}
+	var accStruct AccountStruct
+	found, err := versionAsOf(stub, accountRef(assignStruct.PolicyPrefix, assignStruct.AccountNumber), date, &accStruct)
+	if err != nil {
+		return err
+	}
+	if !found || !accountActiveOn(accStruct, date) {
+		return errorf(codeValidation, "Assignment %s: account %s %s is not active on %s", assignStruct.AssignmentId, assignStruct.PolicyPrefix, assignStruct.AccountNumber, date).withField("accountNumber").withKey(key)
+	}
+
+	return nil
+}
+
+// assignmentIndexKeys returns the index keys under which an assignment is
+// reachable from the marketers and the account it references.
+func assignmentIndexKeys(assignStruct AssignmentStruct) ([]string, error) {
+	var keys []string
+	for _, eId := range []string{assignStruct.EId, assignStruct.OwnerEId} {
+		key, err := compositeKey(assignmentByMarketerKeyType, eId, assignStruct.AssignmentId)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	key, err := compositeKey(assignmentByAccountKeyType, assignStruct.PolicyPrefix, assignStruct.AccountNumber, assignStruct.AssignmentId)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(keys, key), nil
+}
+
+// reindexAssignment moves an assignment's index entries from what the old
+// record referenced (nil for a new assignment) to what the new one does.
+func reindexAssignment(stub shim.ChaincodeStubInterface, old *AssignmentStruct, assignStruct AssignmentStruct) error {
+	newKeys, err := assignmentIndexKeys(assignStruct)
+	if err != nil {
+		return err
+	}
+
+	var oldKeys []string
+	if old != nil {
+		if oldKeys, err = assignmentIndexKeys(*old); err != nil {
+			return err
+		}
+	}
+
+	return moveIndexEntries(stub, oldKeys, newKeys)
+}
+
+// moveIndexEntries deletes the index keys in oldKeys that are not in newKeys
+// and writes those in newKeys.
+func moveIndexEntries(stub shim.ChaincodeStubInterface, oldKeys, newKeys []string) error {
+	keep := make(map[string]bool, len(newKeys))
+	for _, key := range newKeys {
+		keep[key] = true
+	}
+
+	for _, key := range oldKeys {
+		if keep[key] {
+			continue
+		}
+		if err := stub.DelState(key); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range newKeys {
+		if err := stub.PutState(key, indexValue); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// referencingAssignments loads every assignment reachable through the index
+// range of keyType and attrs, ordered by assignmentId.
+func referencingAssignments(stub shim.ChaincodeStubInterface, keyType string, attrs ...string) ([]AssignmentStruct, error) {
+	startKey, endKey, err := prefixRange(keyType, attrs...)
+	if err != nil {
+		return nil, err
+	}
+	indexKeys, err := scanKeys(stub, startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(indexKeys))
+	var assignments []AssignmentStruct
+	for _, indexKey := range indexKeys {
+		_, parts := splitCompositeKey(indexKey)
+		assignmentId := parts[len(parts)-1]
+		if seen[assignmentId] {
+			continue
+		}
+		seen[assignmentId] = true
+
+		_, assignStruct, err := getAssignment(stub, assignmentId)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, assignStruct)
+	}
+	sort.Sort(byAssignmentId(assignments))
+
+	return assignments, nil
+}
+
+type byAssignmentId []AssignmentStruct
+
+func (a byAssignmentId) Len() int           { return len(a) }
+func (a byAssignmentId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAssignmentId) Less(i, j int) bool { return a[i].AssignmentId < a[j].AssignmentId }
+
+// applyReferencePolicy handles the assignments still active on date that
+// point at a marketer or account about to be terminated or deleted. Under
+// policyBlock they make the operation fail; under policyCascade each one is
+// terminated as of date, or removed altogether when remove is set, provided
+// the caller's org owns every one of them.
+func applyReferencePolicy(stub shim.ChaincodeStubInterface, what string, assignments []AssignmentStruct, date, policy string, remove bool) error {
+	var blocking []AssignmentStruct
+	for _, assignStruct := range assignments {
+		if remove || assignmentActiveOn(assignStruct, date) {
+			blocking = append(blocking, assignStruct)
+		}
+	}
+	if len(blocking) == 0 {
+		return nil
+	}
+
+	if policy != policyCascade {
+		ids := make([]string, len(blocking))
+		for i, assignStruct := range blocking {
+			ids[i] = assignStruct.AssignmentId
+		}
+		return errorf(codeConflict, "%s is still referenced by assignment(s) %s; use the %q policy to include them",
+			what, strings.Join(ids, ", "), policyCascade).withDetails(ids)
+	}
+
+	for _, assignStruct := range blocking {
+		key, err := assignmentKey(assignStruct.AssignmentId)
+		if err != nil {
+			return err
+		}
+		if err = checkOrg(stub, key, assignStruct.OrgName); err != nil {
+			return err
+		}
+	}
+
+	for _, assignStruct := range blocking {
+		if remove {
+			if err := deleteAssignment(stub, assignStruct); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ref := assignmentRef(assignStruct.AssignmentId)
+		if err := baseVersion(stub, ref, assignStruct.AssignmentEffectiveDate, date, &assignStruct); err != nil {
+			return err
+		}
+		assignStruct.AssignmentStatus = assignmentTerminated
+		assignStruct.AssignmentEndDate = date
+		assignStruct.Version++
+		if _, err := commitVersion(stub, ref, date, &assignStruct); err != nil {
+			return err
+		}
+		fmt.Println("*** cascaded termination to assignment " + assignStruct.AssignmentId)
+	}
+
+	return nil
+}
+
+// deleteAssignment removes an assignment together with its index entries.
+func deleteAssignment(stub shim.ChaincodeStubInterface, assignStruct AssignmentStruct) error {
+	key, err := assignmentKey(assignStruct.AssignmentId)
+	if err != nil {
+		return err
+	}
+	indexKeys, err := assignmentIndexKeys(assignStruct)
+	if err != nil {
+		return err
+	}
+
+	for _, indexKey := range indexKeys {
+		if err = stub.DelState(indexKey); err != nil {
+			return err
+		}
+	}
+	if err = delEntity(stub, key); err != nil {
+		return err
+	}
+	if err = dropPending(stub, assignmentRef(assignStruct.AssignmentId)); err != nil {
+		return err
+	}
+	fmt.Println("*** deleted assignment " + assignStruct.AssignmentId)
+
+	return nil
+}
+
+// marketerAssignments returns the assignments in which eId is the marketer or the owner.
+func marketerAssignments(stub shim.ChaincodeStubInterface, eId string) ([]AssignmentStruct, error) {
+	return referencingAssignments(stub, assignmentByMarketerKeyType, eId)
+}
+
+// accountAssignments returns the assignments on an account.
+func accountAssignments(stub shim.ChaincodeStubInterface, policyPrefix, accountNumber string) ([]AssignmentStruct, error) {
+	return referencingAssignments(stub, assignmentByAccountKeyType, policyPrefix, accountNumber)
+}
+
+// deleteMarketer - invoke function to remove a marketer. args are the eId and
+// an optional reference policy; with "cascade" every assignment referencing
+// the marketer is deleted as well.
+func (t *SimpleChaincode) deleteMarketer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting 1 or 2")
+	}
+	policy, err := parseReferencePolicy(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	key, mktrStruct, err := getMarketer(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	assignments, err := marketerAssignments(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = applyReferencePolicy(stub, "Marketer "+args[0], assignments, "", policy, true); err != nil {
+		return nil, err
+	}
+
+	if err = delEntity(stub, key); err != nil {
+		return nil, err
+	}
+	if err = reindexMarketer(stub, &mktrStruct, MarketerStruct{}); err != nil {
+		return nil, err
+	}
+	if err = dropPending(stub, marketerRef(args[0])); err != nil {
+		return nil, err
+	}
+	fmt.Println("*** deleted marketer " + args[0])
+
+	return []byte("Marketer deleted succesfully!"), nil
+}
+
+// deleteAccount - invoke function to remove an account. args are the
+// policyPrefix, the accountNumber and an optional reference policy; with
+// "cascade" every assignment on the account is deleted as well.
+func (t *SimpleChaincode) deleteAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting 2 or 3")
+	}
+	policy, err := parseReferencePolicy(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, err := getAccount(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	assignments, err := accountAssignments(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if err = applyReferencePolicy(stub, "Account "+key, assignments, "", policy, true); err != nil {
+		return nil, err
+	}
+
+	if err = delEntity(stub, key); err != nil {
+		return nil, err
+	}
+	if err = dropPending(stub, accountRef(args[0], args[1])); err != nil {
+		return nil, err
+	}
+	fmt.Println("*** deleted account " + key)
+
+	return []byte("Account deleted succesfully!"), nil
+}
+
+// terminateAccount - invoke function to set an account's status to
+// Terminated. args are the policyPrefix, the accountNumber, the YYYY-MM-DD
+// termination date and an optional reference policy; with "cascade" the
+// assignments still active on that date are terminated as of the same date.
+func (t *SimpleChaincode) terminateAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting 3 or 4")
+	}
+	if _, err := parseDate("effectiveDate", args[2]); err != nil {
+		return nil, err
+	}
+	policy, err := parseReferencePolicy(args, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	key, head, err := getAccount(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	var accStruct AccountStruct
+	ref := accountRef(args[0], args[1])
+	if err = baseVersion(stub, ref, head.AccountEffectiveDate, args[2], &accStruct); err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(accStruct.AccountStatus, accountTerminated) {
+		return nil, newError(codeConflict, "Account is already terminated").withKey(key)
+	}
+
+	assignments, err := accountAssignments(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if err = applyReferencePolicy(stub, "Account "+key, assignments, args[2], policy, false); err != nil {
+		return nil, err
+	}
+
+	accStruct.AccountStatus = accountTerminated
+	accStruct.AccountStatusEffectiveDate = args[2]
+	accStruct.Version++
+	pending, err := commitVersion(stub, ref, args[2], &accStruct)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("*** terminated account " + key)
+
+	return changeMessage("Account", "terminated", args[2], pending), nil
+}
+
+// assignmentRefsChanged reports whether an update touches any of the fields
+// checkAssignmentRefs depends on.
+func assignmentRefsChanged(patch map[string]json.RawMessage) bool {
+	for _, name := range []string{"eId", "ownerEId", "policyPrefix", "accountNumber", "assignmentEffectiveDate", "assignmentStatus"} {
+		if _, ok := patch[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
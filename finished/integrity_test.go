@@ -0,0 +1,116 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// keysWithPrefix returns the stored keys starting with prefix.
+func keysWithPrefix(stub *testStub, prefix string) []string {
+	var keys []string
+	for key := range stub.State {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func TestAssignRejectsDanglingReferences(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 2)
+
+	for what, arg := range map[string]string{
+		"a missing marketer":                       `{"assignmentId":"S1","eId":"E9","ownerEId":"E1","policyPrefix":"P","accountNumber":"A1","splitPercentage":"100","assignmentEffectiveDate":"2017-06-01"}`,
+		"a missing owner":                          `{"assignmentId":"S1","eId":"E1","ownerEId":"E9","policyPrefix":"P","accountNumber":"A1","splitPercentage":"100","assignmentEffectiveDate":"2017-06-01"}`,
+		"a missing account":                        `{"assignmentId":"S1","eId":"E1","ownerEId":"E1","policyPrefix":"P","accountNumber":"A9","splitPercentage":"100","assignmentEffectiveDate":"2017-06-01"}`,
+		"references not yet in effect on its date": `{"assignmentId":"S1","eId":"E1","ownerEId":"E1","policyPrefix":"P","accountNumber":"A1","splitPercentage":"100","assignmentEffectiveDate":"2016-06-01"}`,
+	} {
+		if payload, err := stub.invoke(cc, "assign", arg); errorCode(err) != codeValidation {
+			t.Errorf("assign with %s: got %q, %v; want a %s error", what, payload, err, codeValidation)
+		}
+	}
+	if stub.State["ASSIGNMENT~S1"] != nil {
+		t.Error("a rejected assignment was stored")
+	}
+
+	// A Terminated assignment only needs its references to exist.
+	stub.mustInvoke(t, cc, "assign", `{"assignmentId":"S1","eId":"E1","ownerEId":"E1","policyPrefix":"P","accountNumber":"A1","splitPercentage":"100","assignmentEffectiveDate":"2016-06-01","assignmentEndDate":"2016-12-31","assignmentStatus":"Terminated"}`)
+}
+
+func TestReferencesBlockDeletes(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 3)
+
+	for _, call := range [][]string{
+		{"deleteMarketer", "E1"},
+		{"deleteAccount", "P", "A1"},
+		{"terminateAccount", "P", "A1", "2017-07-01"},
+	} {
+		if payload, err := stub.invoke(cc, call[0], call[1:]...); errorCode(err) != codeConflict {
+			t.Errorf("%s of a referenced record: got %q, %v; want a %s error", call[0], payload, err, codeConflict)
+		}
+	}
+	if payload, err := stub.invoke(cc, "deleteMarketer", "E1", "orphan"); errorCode(err) != codeBadRequest {
+		t.Errorf("deleteMarketer with an unknown policy: got %q, %v; want a %s error", payload, err, codeBadRequest)
+	}
+	if stub.State["MARKETER~E1"] == nil || stub.State["ASSIGNMENT~S1"] == nil {
+		t.Fatal("a blocked delete removed records")
+	}
+}
+
+func TestCascadeDelete(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 3)
+
+	stub.mustInvoke(t, cc, "deleteMarketer", "E1", "cascade")
+	for _, key := range []string{"MARKETER~E1", "ASSIGNMENT~S1"} {
+		if stub.State[key] != nil {
+			t.Errorf("cascading deleteMarketer left %s", key)
+		}
+	}
+	for _, prefix := range []string{"ASSIGNMENT_BY_MARKETER~", "ASSIGNMENT_BY_ACCOUNT~", "MARKETER_BY_"} {
+		if keys := keysWithPrefix(stub, prefix); len(keys) != 0 {
+			t.Errorf("cascading deleteMarketer left the index keys %q", keys)
+		}
+	}
+	if _, err := cc.Query(stub, "readAssignment", []string{"S1"}); errorCode(err) != codeNotFound {
+		t.Errorf("readAssignment after the cascade: got %v, want a %s error", err, codeNotFound)
+	}
+
+	// Nothing references the account any more.
+	stub.mustInvoke(t, cc, "deleteAccount", "P", "A1")
+}
+
+func TestCascadeTermination(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 3)
+
+	stub.mustInvoke(t, cc, "terminateAccount", "P", "A1", "2017-07-01", "cascade")
+
+	var assignStruct AssignmentStruct
+	if err := getEntity(stub, assignmentDocType, "ASSIGNMENT~S1", &assignStruct); err != nil {
+		t.Fatalf("assignment S1 after the cascade: %v", err)
+	}
+	if assignStruct.AssignmentStatus != assignmentTerminated || assignStruct.AssignmentEndDate != "2017-07-01" || assignStruct.Version != 2 {
+		t.Errorf("cascading terminateAccount left S1 %+v; want it Terminated on 2017-07-01 in version 2", assignStruct)
+	}
+	var accStruct AccountStruct
+	if err := getEntity(stub, accountDocType, "ACCOUNT~P~A1", &accStruct); err != nil || accStruct.AccountStatus != accountTerminated {
+		t.Errorf("account after terminateAccount: got %+v, %v; want it Terminated", accStruct, err)
+	}
+}
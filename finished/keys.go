@@ -0,0 +1,326 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Every entity lives under TYPE~attr1~attr2..., so the key spaces of the
+// different entity types can never collide.
+const (
+	keySeparator = "~"
+
+	marketerKeyType   = "MARKETER"
+	accountKeyType    = "ACCOUNT"
+	assignmentKeyType = "ASSIGNMENT"
+	migrationKeyType  = "MIGRATION"
+	configKeyType     = "CONFIG"
+
+	// Index keys pointing from a marketer or account to the assignments
+	// that reference it. They carry no value of their own.
+	assignmentByMarketerKeyType = "ASSIGNMENT_BY_MARKETER"
+	assignmentByAccountKeyType  = "ASSIGNMENT_BY_ACCOUNT"
+
+	// Index keys pointing from a marketer attribute value to the eIds
+	// holding it.
+	marketerByTaxIdKeyType    = "MARKETER_BY_TAXID"
+	marketerByOrgKeyType      = "MARKETER_BY_ORG"
+	marketerByStateKeyType    = "MARKETER_BY_STATE"
+	marketerByRegStateKeyType = "MARKETER_BY_REGSTATE"
+	marketerByStatusKeyType   = "MARKETER_BY_STATUS"
+
+	// maxKeySuffix sorts after every valid UTF-8 key, closing a range scan over a prefix.
+	maxKeySuffix = "\U0010FFFF"
+)
+
+// docType values stored in every entity document.
+const (
+	marketerDocType   = "marketer"
+	accountDocType    = "account"
+	assignmentDocType = "assignment"
+)
+
+// compositeKey joins a type prefix and its attributes. Attributes may not be
+// empty or contain the separator, otherwise two different entities could map
+// to the same key.
+func compositeKey(keyType string, attrs ...string) (string, error) {
+	for _, attr := range attrs {
+		if attr == "" {
+			return "", errorf(codeValidation, "Empty %s key attribute", keyType)
+		}
+		if strings.Contains(attr, keySeparator) {
+			return "", errorf(codeValidation, "%s key attribute %q may not contain %q", keyType, attr, keySeparator)
+		}
+	}
+
+	return keyType + keySeparator + strings.Join(attrs, keySeparator), nil
+}
+
+// splitCompositeKey is the inverse of compositeKey.
+func splitCompositeKey(key string) (string, []string) {
+	parts := strings.Split(key, keySeparator)
+	return parts[0], parts[1:]
+}
+
+func marketerKey(eId string) (string, error) {
+	return compositeKey(marketerKeyType, eId)
+}
+
+func accountKey(policyPrefix, accountNumber string) (string, error) {
+	return compositeKey(accountKeyType, policyPrefix, accountNumber)
+}
+
+func assignmentKey(assignmentId string) (string, error) {
+	return compositeKey(assignmentKeyType, assignmentId)
+}
+
+// indexValue is stored under index keys, which only matter for their name.
+var indexValue = []byte{0x00}
+
+// prefixRange returns the start and end keys of a range scan covering every
+// key built from keyType and the given leading attributes.
+func prefixRange(keyType string, attrs ...string) (string, string, error) {
+	prefix, err := compositeKey(keyType, attrs...)
+	if err != nil {
+		return "", "", err
+	}
+	if len(attrs) > 0 {
+		prefix += keySeparator
+	}
+
+	return prefix, prefix + maxKeySuffix, nil
+}
+
+// scanKeys returns every key in [startKey, endKey] in key order.
+func scanKeys(stub shim.ChaincodeStubInterface, startKey, endKey string) ([]string, error) {
+	iter, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var keys []string
+	for iter.HasNext() {
+		key, _, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// runOnce runs the migration called name, described as what in errors,
+// unless MIGRATION~name records that it already has. The JSON encoding of
+// the migration's result is recorded there and returned.
+func runOnce(stub shim.ChaincodeStubInterface, name, what string, migrate func() (interface{}, error)) ([]byte, error) {
+	markerKey, err := compositeKey(migrationKeyType, name)
+	if err != nil {
+		return nil, err
+	}
+	done, err := stub.GetState(markerKey)
+	if err != nil {
+		return nil, err
+	}
+	if done != nil {
+		return nil, errorf(codeConflict, "%s has already run", what).withKey(markerKey)
+	}
+
+	result, err := migrate()
+	if err != nil {
+		return nil, err
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	if err = stub.PutState(markerKey, resultBytes); err != nil {
+		return nil, err
+	}
+
+	return resultBytes, nil
+}
+
+// migrateKeys - invoke function that moves records written under the old flat
+// keys (eId, AccountNumber, AssignmentId) to their composite keys. It can only
+// run once; the outcome is recorded under MIGRATION~keys. Marketers are sealed
+// on the way, so the piiKey must be in the transaction metadata; records that
+// cannot be moved, sealed or indexed are skipped and reported.
+func (t *SimpleChaincode) migrateKeys(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	// Without the key every marketer would be skipped, and the migration
+	// could not be run again to move them.
+	if _, err := requirePIIKey(stub, "Key migration", ""); err != nil {
+		return nil, err
+	}
+
+	return runOnce(stub, "keys", "Key migration", func() (interface{}, error) {
+		// Collect first, then rewrite, so the iterator never sees our own writes.
+		type legacyRecord struct {
+			key   string
+			value []byte
+		}
+		var legacy []legacyRecord
+
+		iter, err := stub.RangeQueryState("", maxKeySuffix)
+		if err != nil {
+			return nil, err
+		}
+		for iter.HasNext() {
+			key, value, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			if strings.Contains(key, keySeparator) {
+				continue
+			}
+			legacy = append(legacy, legacyRecord{key, value})
+		}
+		iter.Close()
+
+		result := struct {
+			Migrated []string `json:"migrated"`
+			Skipped  []string `json:"skipped"`
+		}{Migrated: []string{}, Skipped: []string{}}
+
+		for _, rec := range legacy {
+			newKey, record, newValue, err := rekeyLegacyRecord(rec.value)
+			if err != nil {
+				fmt.Println("*** skipping " + rec.key + ": " + err.Error())
+				result.Skipped = append(result.Skipped, rec.key)
+				continue
+			}
+
+			existing, err := stub.GetState(newKey)
+			if err != nil {
+				return nil, err
+			}
+			if existing != nil {
+				fmt.Println("*** skipping " + rec.key + ": " + newKey + " already exists")
+				result.Skipped = append(result.Skipped, rec.key)
+				continue
+			}
+			if mktrStruct, ok := record.(MarketerStruct); ok {
+				if err = sealMarketer(stub, &mktrStruct); err != nil {
+					if errorCode(err) == "" {
+						return nil, err
+					}
+					fmt.Println("*** skipping " + rec.key + ": " + err.Error())
+					result.Skipped = append(result.Skipped, rec.key)
+					continue
+				}
+				if err = checkTaxIdUnique(stub, mktrStruct.EId, mktrStruct.TaxIdHash); err != nil {
+					fmt.Println("*** skipping " + rec.key + ": " + err.Error())
+					result.Skipped = append(result.Skipped, rec.key)
+					continue
+				}
+				if newValue, err = json.Marshal(mktrStruct); err != nil {
+					return nil, err
+				}
+				record = mktrStruct
+			}
+
+			if err = putEntity(stub, newKey, newValue); err != nil {
+				return nil, err
+			}
+			if err = stub.DelState(rec.key); err != nil {
+				return nil, err
+			}
+			switch r := record.(type) {
+			case AssignmentStruct:
+				err = reindexAssignment(stub, nil, r)
+			case MarketerStruct:
+				err = reindexMarketer(stub, nil, r)
+			}
+			if err != nil {
+				return nil, err
+			}
+			result.Migrated = append(result.Migrated, newKey)
+		}
+
+		fmt.Printf("*** migrated %d records, skipped %d\n", len(result.Migrated), len(result.Skipped))
+
+		return result, nil
+	})
+}
+
+// rekeyLegacyRecord works out which entity a flat-keyed record holds from the
+// fields it carries and returns its composite key and the record stamped with
+// its docType, both decoded and encoded. Assignments are checked first as they also carry the account
+// and marketer identifiers.
+func rekeyLegacyRecord(value []byte) (string, interface{}, []byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return "", nil, nil, errors.New("not a JSON record")
+	}
+	has := func(name string) bool {
+		s, ok := fields[name].(string)
+		return ok && s != ""
+	}
+
+	var key string
+	var record interface{}
+	var err error
+	switch {
+	case has("assignmentId"):
+		var assignStruct AssignmentStruct
+		err = json.Unmarshal(value, &assignStruct)
+		assignStruct.ObjectType = assignmentDocType
+		if assignStruct.Version == 0 {
+			assignStruct.Version = 1
+		}
+		record = assignStruct
+		if err == nil {
+			key, err = assignmentKey(assignStruct.AssignmentId)
+		}
+	case has("accountNumber"):
+		var accStruct AccountStruct
+		err = json.Unmarshal(value, &accStruct)
+		accStruct.ObjectType = accountDocType
+		if accStruct.Version == 0 {
+			accStruct.Version = 1
+		}
+		record = accStruct
+		if err == nil {
+			key, err = accountKey(accStruct.PolicyPrefix, accStruct.AccountNumber)
+		}
+	case has("eId"):
+		var mktrStruct MarketerStruct
+		err = json.Unmarshal(value, &mktrStruct)
+		mktrStruct.ObjectType = marketerDocType
+		record = mktrStruct
+		if err == nil {
+			key, err = marketerKey(mktrStruct.EId)
+		}
+	default:
+		return "", nil, nil, errors.New("unrecognised record")
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return key, record, recordBytes, nil
+}
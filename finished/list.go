@@ -0,0 +1,231 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// List queries take their filter arguments first, then an optional page size
+// and an optional continuation token copied from the previous page. Pages
+// are cut in key order and a token resumes right after the last key
+// returned, so records never repeat or go missing across pages because of
+// writes made between calls; only records created behind the cursor are
+// not seen.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// page is the result of a list query. NextToken is empty on the last page.
+type page struct {
+	Records   []interface{} `json:"records"`
+	NextToken string        `json:"nextToken,omitempty"`
+}
+
+// parsePageArgs reads the optional page size and token at args[idx] and
+// args[idx+1]. Nothing may follow them.
+func parsePageArgs(args []string, idx int) (int, string, error) {
+	if len(args) < idx || len(args) > idx+2 {
+		return 0, "", errorf(codeBadRequest, "Incorrect number of arguments. Expecting %d to %d", idx, idx+2)
+	}
+
+	size := defaultPageSize
+	if len(args) > idx && args[idx] != "" {
+		n, err := strconv.Atoi(args[idx])
+		if err != nil || n < 1 || n > maxPageSize {
+			return 0, "", errorf(codeBadRequest, "pageSize must be a number from 1 to %d, got %q", maxPageSize, args[idx]).withField("pageSize")
+		}
+		size = n
+	}
+
+	var token string
+	if len(args) > idx+1 {
+		token = args[idx+1]
+	}
+
+	return size, token, nil
+}
+
+// pageKeys returns up to size keys of [startKey, endKey] following the key
+// encoded in token, and the token for the next page.
+func pageKeys(stub shim.ChaincodeStubInterface, startKey, endKey string, size int, token string) ([]string, string, error) {
+	resumeKey := startKey
+	if token != "" {
+		lastKey, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil || !strings.HasPrefix(string(lastKey), startKey) || string(lastKey) > endKey {
+			return nil, "", newError(codeBadRequest, "Invalid continuation token").withField("token")
+		}
+		// The smallest key sorting after lastKey.
+		resumeKey = string(lastKey) + "\x00"
+	}
+
+	iter, err := stub.RangeQueryState(resumeKey, endKey)
+	if err != nil {
+		return nil, "", err
+	}
+	defer iter.Close()
+
+	var keys []string
+	for iter.HasNext() {
+		key, _, err := iter.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		if len(keys) == size {
+			return keys, base64.RawURLEncoding.EncodeToString([]byte(keys[size-1])), nil
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, "", nil
+}
+
+// listPage builds a page over the keys of keyType that start with attrs.
+// load turns each key into the record to return.
+func listPage(stub shim.ChaincodeStubInterface, keyType string, attrs []string, size int, token string, load func(key string) (interface{}, error)) ([]byte, error) {
+	startKey, endKey, err := prefixRange(keyType, attrs...)
+	if err != nil {
+		return nil, err
+	}
+	keys, next, err := pageKeys(stub, startKey, endKey, size, token)
+	if err != nil {
+		return nil, err
+	}
+
+	result := page{Records: make([]interface{}, 0, len(keys)), NextToken: next}
+	for _, key := range keys {
+		record, err := load(key)
+		if err != nil {
+			return nil, err
+		}
+		result.Records = append(result.Records, record)
+	}
+
+	return json.Marshal(result)
+}
+
+// lastAttr returns the final attribute of an index key: the id it points at.
+func lastAttr(key string) string {
+	_, parts := splitCompositeKey(key)
+	return parts[len(parts)-1]
+}
+
+func loadMarketer(stub shim.ChaincodeStubInterface) func(string) (interface{}, error) {
+	return func(key string) (interface{}, error) {
+		var mktrStruct MarketerStruct
+		err := getEntity(stub, marketerDocType, key, &mktrStruct)
+		presentMarketer(stub, &mktrStruct)
+		return mktrStruct, err
+	}
+}
+
+func loadIndexedMarketer(stub shim.ChaincodeStubInterface) func(string) (interface{}, error) {
+	return func(indexKey string) (interface{}, error) {
+		_, mktrStruct, err := getMarketer(stub, lastAttr(indexKey))
+		presentMarketer(stub, &mktrStruct)
+		return mktrStruct, err
+	}
+}
+
+func loadAccount(stub shim.ChaincodeStubInterface) func(string) (interface{}, error) {
+	return func(key string) (interface{}, error) {
+		var accStruct AccountStruct
+		err := getEntity(stub, accountDocType, key, &accStruct)
+		return accStruct, err
+	}
+}
+
+func loadAssignment(stub shim.ChaincodeStubInterface) func(string) (interface{}, error) {
+	return func(key string) (interface{}, error) {
+		var assignStruct AssignmentStruct
+		err := getEntity(stub, assignmentDocType, key, &assignStruct)
+		return assignStruct, err
+	}
+}
+
+func loadIndexedAssignment(stub shim.ChaincodeStubInterface) func(string) (interface{}, error) {
+	return func(indexKey string) (interface{}, error) {
+		_, assignStruct, err := getAssignment(stub, lastAttr(indexKey))
+		return assignStruct, err
+	}
+}
+
+// listMarketers - query function to page through all marketers by eId.
+// args are the optional pageSize and continuation token.
+func (t *SimpleChaincode) listMarketers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	size, token, err := parsePageArgs(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return listPage(stub, marketerKeyType, nil, size, token, loadMarketer(stub))
+}
+
+// listAccounts - query function to page through the accounts of a policy
+// prefix, or of every prefix when args[0] is empty. args[1] and args[2] are
+// the optional pageSize and continuation token.
+func (t *SimpleChaincode) listAccounts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	size, token, err := parsePageArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs []string
+	if args[0] != "" {
+		attrs = args[:1]
+	}
+
+	return listPage(stub, accountKeyType, attrs, size, token, loadAccount(stub))
+}
+
+// listAssignments - query function to page through all assignments by
+// assignmentId. args are the optional pageSize and continuation token.
+func (t *SimpleChaincode) listAssignments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	size, token, err := parsePageArgs(args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return listPage(stub, assignmentKeyType, nil, size, token, loadAssignment(stub))
+}
+
+// assignmentsByMarketer - query function to page through the assignments in
+// which args[0] is the marketer or the owner. args[1] and args[2] are the
+// optional pageSize and continuation token.
+func (t *SimpleChaincode) assignmentsByMarketer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	size, token, err := parsePageArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return listPage(stub, assignmentByMarketerKeyType, args[:1], size, token, loadIndexedAssignment(stub))
+}
+
+// assignmentsByAccount - query function to page through the assignments on
+// the account args[0], args[1]. args[2] and args[3] are the optional
+// pageSize and continuation token.
+func (t *SimpleChaincode) assignmentsByAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	size, token, err := parsePageArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return listPage(stub, assignmentByAccountKeyType, args[:2], size, token, loadIndexedAssignment(stub))
+}
@@ -0,0 +1,107 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// writeMarketers writes a marketer for each of the single-digit eIds, with
+// TaxIds of their own.
+func writeMarketers(t *testing.T, cc *SimpleChaincode, stub *testStub, eIds ...string) {
+	for _, eId := range eIds {
+		stub.mustInvoke(t, cc, "write", fmt.Sprintf(`{"eId":%q,"taxId":"100-00-000%s","legalName":"Marketer %s"}`, eId, eId[1:], eId))
+	}
+}
+
+func TestPageTokens(t *testing.T) {
+	cc, stub := newTestStub(t)
+	writeMarketers(t, cc, stub, "E1", "E2", "E3", "E4", "E5")
+
+	got, token := queryPage(t, cc, stub, "eId", "listMarketers", "2")
+	if !reflect.DeepEqual(got, []string{"E1", "E2"}) || token == "" {
+		t.Fatalf("first page: got %q, token %q", got, token)
+	}
+
+	// Writes between pages neither repeat nor drop records ahead of the cursor.
+	stub.mustInvoke(t, cc, "deleteMarketer", "E1")
+	writeMarketers(t, cc, stub, "E0", "E6")
+
+	var all []string
+	for token != "" {
+		got, token = queryPage(t, cc, stub, "eId", "listMarketers", "2", token)
+		all = append(all, got...)
+	}
+	if want := []string{"E3", "E4", "E5", "E6"}; !reflect.DeepEqual(all, want) {
+		t.Errorf("later pages: got %q, want %q", all, want)
+	}
+
+	// A page holding the last record carries no token.
+	if got, token = queryPage(t, cc, stub, "eId", "listMarketers", "6"); len(got) != 6 || token != "" {
+		t.Errorf("listMarketers of all 6: got %q, token %q", got, token)
+	}
+	if got, token = queryPage(t, cc, stub, "eId", "listMarketers"); len(got) != 6 || token != "" {
+		t.Errorf("listMarketers with the default page size: got %q, token %q", got, token)
+	}
+}
+
+func TestPagedIndexQueries(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 2)
+	for _, id := range []string{"S1", "S2", "S3"} {
+		stub.mustInvoke(t, cc, "assign", assignSplit(id, "Primary", "10", "2017-06-01"))
+	}
+
+	var all []string
+	got, token := queryPage(t, cc, stub, "assignmentId", "assignmentsByAccount", "P", "A1", "2")
+	all = append(all, got...)
+	got, token = queryPage(t, cc, stub, "assignmentId", "assignmentsByAccount", "P", "A1", "2", token)
+	all = append(all, got...)
+	if want := []string{"S1", "S2", "S3"}; !reflect.DeepEqual(all, want) || token != "" {
+		t.Errorf("assignmentsByAccount in pages of 2: got %q, token %q; want %q", all, token, want)
+	}
+
+	// A token only resumes the list it came from.
+	_, token = queryPage(t, cc, stub, "assignmentId", "listAssignments", "1")
+	if payload, err := cc.Query(stub, "listMarketers", []string{"1", token}); errorCode(err) != codeBadRequest {
+		t.Errorf("listMarketers with a listAssignments token: got %q, %v; want a %s error", payload, err, codeBadRequest)
+	}
+	if payload, err := cc.Query(stub, "assignmentsByMarketer", []string{"E2", "1", token}); errorCode(err) != codeBadRequest {
+		t.Errorf("assignmentsByMarketer with a listAssignments token: got %q, %v; want a %s error", payload, err, codeBadRequest)
+	}
+}
+
+func TestPageArgs(t *testing.T) {
+	cc, stub := newTestStub(t)
+
+	for _, args := range [][]string{
+		{"0"},
+		{"201"},
+		{"ten"},
+		{"2", "not base64!"},
+		{"2", "", "extra"},
+	} {
+		if payload, err := cc.Query(stub, "listMarketers", args); errorCode(err) != codeBadRequest {
+			t.Errorf("listMarketers %q: got %q, %v; want a %s error", args, payload, err, codeBadRequest)
+		}
+	}
+	if payload, err := cc.Query(stub, "marketersByOrg", nil); errorCode(err) != codeBadRequest {
+		t.Errorf("marketersByOrg without an org: got %q, %v; want a %s error", payload, err, codeBadRequest)
+	}
+	if got, token := queryPage(t, cc, stub, "eId", "listMarketers", "", ""); len(got) != 0 || token != "" {
+		t.Errorf("listMarketers of an empty ledger: got %q, token %q", got, token)
+	}
+}
@@ -0,0 +1,375 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// The TaxId index is keyed by a salted HMAC of the TaxId rather than the
+// TaxId itself. The salt is chosen once, by Init or by the first write that
+// hashes a TaxId, and is no secret: it derives from a transaction ID. The
+// HMAC key is derived from the PII key instead, so only holders of that key
+// can hash, and so probe, TaxIds. Hashing is refused until PII sealing is
+// configured and without the key in the transaction metadata, which makes
+// both a requirement for writing marketers with a TaxId. Each marketer
+// keeps the hash of its TaxId in taxIdHash, which lets the index follow a
+// record whose TaxId is sealed.
+const taxIdSaltKey = configKeyType + keySeparator + "taxIdSalt"
+
+// initTaxIdSalt stores the TaxId hash salt unless it is already set:
+// changing it would orphan every index entry.
+func initTaxIdSalt(stub shim.ChaincodeStubInterface) error {
+	salt, err := stub.GetState(taxIdSaltKey)
+	if err != nil || salt != nil {
+		return err
+	}
+
+	sum := sha256.Sum256([]byte("taxIdSalt\x00" + stub.GetTxID()))
+	return stub.PutState(taxIdSaltKey, []byte(hex.EncodeToString(sum[:])))
+}
+
+// normalizeTaxId reduces a TaxId to its digits, so that 123-45-6789 and
+// 123456789 hash alike. Values without digits are only trimmed.
+func normalizeTaxId(taxId string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, taxId)
+	if digits == "" {
+		return strings.TrimSpace(taxId)
+	}
+
+	return digits
+}
+
+// hashTaxId returns the index hash of a raw TaxId. It fails rather than
+// return an empty hash when no salt has been chosen, as on a ledger upgraded
+// without running Init again.
+func hashTaxId(stub shim.ChaincodeStubInterface, taxId string) (string, error) {
+	salt, err := stub.GetState(taxIdSaltKey)
+	if err != nil {
+		return "", err
+	}
+	if salt == nil {
+		return "", newError(codeInternal, "TaxId salt not initialised").withKey(taxIdSaltKey)
+	}
+
+	key, err := requirePIIKey(stub, "Hashing a TaxId", "taxId")
+	if err != nil {
+		return "", err
+	}
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("taxIdIndex"))
+
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write(salt)
+	mac.Write([]byte{0})
+	mac.Write([]byte(normalizeTaxId(taxId)))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// setTaxIdHash brings taxIdHash in line with the TaxId. A sealed TaxId
+// cannot be hashed; it keeps the hash it was stored with or, lacking one,
+// takes that of prev (the stored record, may be nil) if prev holds the same
+// sealed TaxId. Sealing is deterministic, so that is the same TaxId.
+func setTaxIdHash(stub shim.ChaincodeStubInterface, mktrStruct *MarketerStruct, prev *MarketerStruct) error {
+	switch {
+	case mktrStruct.TaxId == "":
+		mktrStruct.TaxIdHash = ""
+	case isSealed(mktrStruct.TaxId):
+		if mktrStruct.TaxIdHash == "" && prev != nil && prev.TaxId == mktrStruct.TaxId {
+			mktrStruct.TaxIdHash = prev.TaxIdHash
+		}
+	default:
+		if err := initTaxIdSalt(stub); err != nil {
+			return err
+		}
+		hash, err := hashTaxId(stub, mktrStruct.TaxId)
+		if err != nil {
+			return err
+		}
+		mktrStruct.TaxIdHash = hash
+	}
+
+	return nil
+}
+
+// marketerIndexKeys returns the lookup index keys of a marketer, one per
+// indexed attribute that is set.
+func marketerIndexKeys(mktrStruct MarketerStruct) ([]string, error) {
+	if mktrStruct.EId == "" {
+		return nil, nil
+	}
+
+	indexed := []struct {
+		keyType, value string
+	}{
+		{marketerByTaxIdKeyType, mktrStruct.TaxIdHash},
+		{marketerByOrgKeyType, mktrStruct.OrgName},
+		{marketerByStateKeyType, mktrStruct.State},
+		{marketerByRegStateKeyType, mktrStruct.RegStateName},
+		{marketerByStatusKeyType, mktrStruct.MarketerStatus},
+	}
+
+	var keys []string
+	for _, index := range indexed {
+		if index.value == "" {
+			continue
+		}
+		key, err := compositeKey(index.keyType, index.value, mktrStruct.EId)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// reindexMarketer moves a marketer's lookup index entries from the old
+// record (nil for a new marketer) to the new one. An empty new record
+// removes them.
+func reindexMarketer(stub shim.ChaincodeStubInterface, old *MarketerStruct, mktrStruct MarketerStruct) error {
+	newKeys, err := marketerIndexKeys(mktrStruct)
+	if err != nil {
+		return err
+	}
+
+	var oldKeys []string
+	if old != nil {
+		if oldKeys, err = marketerIndexKeys(*old); err != nil {
+			return err
+		}
+	}
+
+	return moveIndexEntries(stub, oldKeys, newKeys)
+}
+
+// indexedEIds returns the eIds filed under value in the keyType index, in
+// eId order.
+func indexedEIds(stub shim.ChaincodeStubInterface, keyType, value string) ([]string, error) {
+	startKey, endKey, err := prefixRange(keyType, value)
+	if err != nil {
+		return nil, err
+	}
+	indexKeys, err := scanKeys(stub, startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+
+	eIds := make([]string, len(indexKeys))
+	for i, indexKey := range indexKeys {
+		eIds[i] = lastAttr(indexKey)
+	}
+
+	return eIds, nil
+}
+
+// checkTaxIdUnique fails if the TaxId hashing to taxIdHash already belongs
+// to a marketer other than eId.
+func checkTaxIdUnique(stub shim.ChaincodeStubInterface, eId, taxIdHash string) error {
+	if taxIdHash == "" {
+		return nil
+	}
+
+	eIds, err := indexedEIds(stub, marketerByTaxIdKeyType, taxIdHash)
+	if err != nil {
+		return err
+	}
+	for _, other := range eIds {
+		if other != eId {
+			key, _ := marketerKey(other)
+			return errorf(codeDuplicate, "TaxId is already used by marketer %s", other).withField("taxId").withKey(key)
+		}
+	}
+
+	return nil
+}
+
+// marketerLookups maps each list query to the index it reads.
+var marketerLookups = map[string]string{
+	"marketersByOrg":      marketerByOrgKeyType,
+	"marketersByState":    marketerByStateKeyType,
+	"marketersByRegState": marketerByRegStateKeyType,
+	"marketersByStatus":   marketerByStatusKeyType,
+}
+
+// marketersBy - query function behind marketersByOrg, marketersByState,
+// marketersByRegState and marketersByStatus. args[0] is the value to look up;
+// the matching marketers are paged through in eId order, with args[1] and
+// args[2] the optional pageSize and continuation token.
+func (t *SimpleChaincode) marketersBy(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	size, token, err := parsePageArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return listPage(stub, marketerLookups[function], args[:1], size, token, loadIndexedMarketer(stub))
+}
+
+// marketerByTaxId - query function to read the marketer holding the raw
+// TaxId args[0]
+func (t *SimpleChaincode) marketerByTaxId(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if err := checkArgCount(args, 1); err != nil {
+		return nil, err
+	}
+
+	taxIdHash, err := hashTaxId(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	eIds, err := indexedEIds(stub, marketerByTaxIdKeyType, taxIdHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(eIds) == 0 {
+		return nil, newError(codeNotFound, "No marketer has this TaxId").withField("taxId")
+	}
+
+	return t.readMarketer(stub, eIds[:1])
+}
+
+// indexMarketers - invoke function that builds the lookup indexes for
+// marketers written before they existed. It can only run once; marketers
+// whose TaxId is already indexed for another eId are left out of the TaxId
+// index and reported.
+func (t *SimpleChaincode) indexMarketers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return runOnce(stub, "marketerIndexes", "Marketer indexing", func() (interface{}, error) {
+		startKey, endKey, err := prefixRange(marketerKeyType)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := scanKeys(stub, startKey, endKey)
+		if err != nil {
+			return nil, err
+		}
+
+		result := struct {
+			Indexed        []string `json:"indexed"`
+			TaxIdConflicts []string `json:"taxIdConflicts"`
+		}{Indexed: []string{}, TaxIdConflicts: []string{}}
+
+		for _, key := range keys {
+			eId, conflict, err := indexStoredMarketer(stub, key)
+			if err != nil {
+				return nil, err
+			}
+			if conflict {
+				result.TaxIdConflicts = append(result.TaxIdConflicts, eId)
+			}
+			result.Indexed = append(result.Indexed, eId)
+		}
+
+		fmt.Printf("*** indexed %d marketers, %d TaxId conflicts\n", len(result.Indexed), len(result.TaxIdConflicts))
+
+		return result, nil
+	})
+}
+
+// indexStoredMarketer files the marketer stored under key in every lookup
+// index, hashing its TaxId first and storing the hash with the record if it
+// changed. A TaxId whose hash is already indexed for another eId is left out
+// of the TaxId index and reported as a conflict.
+func indexStoredMarketer(stub shim.ChaincodeStubInterface, key string) (string, bool, error) {
+	var mktrStruct MarketerStruct
+	if err := getEntity(stub, marketerDocType, key, &mktrStruct); err != nil {
+		return "", false, err
+	}
+	storedHash := mktrStruct.TaxIdHash
+	if err := sealMarketer(stub, &mktrStruct); err != nil {
+		return "", false, err
+	}
+	if isSealed(mktrStruct.TaxId) && mktrStruct.TaxIdHash == "" {
+		return "", false, errorf(codeForbidden, "Hashing the sealed TaxId of marketer %s requires the piiKey in the transaction metadata", mktrStruct.EId).withField("taxId").withKey(key)
+	}
+
+	conflict := false
+	if err := checkTaxIdUnique(stub, mktrStruct.EId, mktrStruct.TaxIdHash); err != nil {
+		fmt.Println("*** " + key + ": " + err.Error())
+		conflict = true
+		mktrStruct.TaxIdHash = ""
+	}
+	if mktrStruct.TaxIdHash != storedHash {
+		mktrStructBytes, err := json.Marshal(mktrStruct)
+		if err != nil {
+			return "", false, err
+		}
+		if err = putEntity(stub, key, mktrStructBytes); err != nil {
+			return "", false, err
+		}
+	}
+
+	return mktrStruct.EId, conflict, reindexMarketer(stub, nil, mktrStruct)
+}
+
+// hashTaxIdIndex - invoke function that replaces the TaxId index entries
+// keyed by raw TaxIds, written before the index was hashed, with hashed
+// ones. It can only run once; marketers whose TaxId hash is already indexed
+// for another eId are left out of the TaxId index and reported. Sealed
+// TaxIds need the piiKey in the transaction metadata.
+func (t *SimpleChaincode) hashTaxIdIndex(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return runOnce(stub, "taxIdHash", "TaxId index hashing", func() (interface{}, error) {
+		startKey, endKey, err := prefixRange(marketerByTaxIdKeyType)
+		if err != nil {
+			return nil, err
+		}
+		rawKeys, err := scanKeys(stub, startKey, endKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, rawKey := range rawKeys {
+			if err = stub.DelState(rawKey); err != nil {
+				return nil, err
+			}
+		}
+
+		if startKey, endKey, err = prefixRange(marketerKeyType); err != nil {
+			return nil, err
+		}
+		keys, err := scanKeys(stub, startKey, endKey)
+		if err != nil {
+			return nil, err
+		}
+
+		result := struct {
+			Hashed         []string `json:"hashed"`
+			TaxIdConflicts []string `json:"taxIdConflicts"`
+		}{Hashed: []string{}, TaxIdConflicts: []string{}}
+
+		for _, key := range keys {
+			eId, conflict, err := indexStoredMarketer(stub, key)
+			if err != nil {
+				return nil, err
+			}
+			if conflict {
+				result.TaxIdConflicts = append(result.TaxIdConflicts, eId)
+			}
+			result.Hashed = append(result.Hashed, eId)
+		}
+
+		fmt.Printf("*** hashed the TaxIds of %d marketers, %d conflicts\n", len(result.Hashed), len(result.TaxIdConflicts))
+
+		return result, nil
+	})
+}
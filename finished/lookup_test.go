@@ -0,0 +1,155 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// queryPage runs a list query and returns the idField of each record on
+// the page and the next page's token.
+func queryPage(t *testing.T, cc *SimpleChaincode, stub *testStub, idField, function string, args ...string) ([]string, string) {
+	payload, err := cc.Query(stub, function, args)
+	if err != nil {
+		t.Fatalf("%s %q failed: %v", function, args, err)
+	}
+	var result struct {
+		Records   []map[string]interface{} `json:"records"`
+		NextToken string                   `json:"nextToken"`
+	}
+	if err = json.Unmarshal(payload, &result); err != nil {
+		t.Fatalf("%s %q returned %s: %v", function, args, payload, err)
+	}
+
+	ids := []string{}
+	for _, record := range result.Records {
+		id, _ := record[idField].(string)
+		ids = append(ids, id)
+	}
+
+	return ids, result.NextToken
+}
+
+func TestMarketerLookups(t *testing.T) {
+	cc, stub := newTestStub(t)
+	stub.mustInvoke(t, cc, "write", `{"eId":"E1","taxId":"123-45-6789","legalName":"Ann Lee","orgName":"OrgA","state":"NY","regStateName":"NJ","marketerEffectiveDate":"2017-01-01"}`)
+	stub.mustInvoke(t, cc, "write", testPIIMarketer)
+	stub.mustInvoke(t, cc, "write", `{"eId":"E3","taxId":"111-22-3333","legalName":"Cy Diaz","orgName":"OrgB","state":"NY","marketerEffectiveDate":"2017-01-01"}`)
+
+	lookups := []struct {
+		function, value string
+		want            []string
+	}{
+		{"marketersByOrg", "OrgA", []string{"E1", "E2"}},
+		{"marketersByOrg", "OrgB", []string{"E3"}},
+		{"marketersByState", "NY", []string{"E1", "E3"}},
+		{"marketersByRegState", "NJ", []string{"E1"}},
+		{"marketersByStatus", marketerActive, []string{"E1", "E2", "E3"}},
+		{"marketersByOrg", "OrgC", []string{}},
+	}
+	for _, l := range lookups {
+		if got, _ := queryPage(t, cc, stub, "eId", l.function, l.value); !reflect.DeepEqual(got, l.want) {
+			t.Errorf("%s %s: got %q, want %q", l.function, l.value, got, l.want)
+		}
+	}
+
+	// Changes move the marketer between index entries.
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E1","orgName":"OrgB","state":""}`)
+	stub.mustInvoke(t, cc, "suspendMarketer", "E3", "2017-07-01")
+	lookups = []struct {
+		function, value string
+		want            []string
+	}{
+		{"marketersByOrg", "OrgA", []string{"E2"}},
+		{"marketersByOrg", "OrgB", []string{"E1", "E3"}},
+		{"marketersByState", "NY", []string{"E3"}},
+		{"marketersByStatus", marketerActive, []string{"E1", "E2"}},
+		{"marketersByStatus", marketerSuspended, []string{"E3"}},
+	}
+	for _, l := range lookups {
+		if got, _ := queryPage(t, cc, stub, "eId", l.function, l.value); !reflect.DeepEqual(got, l.want) {
+			t.Errorf("%s %s after the changes: got %q, want %q", l.function, l.value, got, l.want)
+		}
+	}
+
+	stub.mustInvoke(t, cc, "deleteMarketer", "E1")
+	if keys := keysWithPrefix(stub, "MARKETER_BY_"); len(keys) != 7 {
+		t.Errorf("index keys after deleting E1: got %q, want only those of E2 and E3", keys)
+	}
+}
+
+func TestMarketerByTaxId(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 1)
+	stub.mustInvoke(t, cc, "write", testPIIMarketer)
+
+	for _, taxId := range []string{"123-45-6789", "123456789", " 123 45 6789 "} {
+		got, err := readMarketerByTaxId(cc, stub, taxId)
+		if err != nil || got != "E1" {
+			t.Errorf("marketerByTaxId %q: got %q, %v; want E1", taxId, got, err)
+		}
+	}
+	if got, err := readMarketerByTaxId(cc, stub, "123-45-6788"); errorCode(err) != codeNotFound {
+		t.Errorf("marketerByTaxId of an unknown TaxId: got %q, %v; want a %s error", got, err, codeNotFound)
+	}
+
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E1","taxId":"111-22-3333"}`)
+	if got, err := readMarketerByTaxId(cc, stub, "111223333"); err != nil || got != "E1" {
+		t.Errorf("marketerByTaxId of the new TaxId: got %q, %v; want E1", got, err)
+	}
+	if got, err := readMarketerByTaxId(cc, stub, "123456789"); errorCode(err) != codeNotFound {
+		t.Errorf("marketerByTaxId of the old TaxId: got %q, %v; want a %s error", got, err, codeNotFound)
+	}
+
+	stub.metadata = nil
+	if got, err := readMarketerByTaxId(cc, stub, "111223333"); errorCode(err) != codeForbidden {
+		t.Errorf("marketerByTaxId without the piiKey: got %q, %v; want a %s error", got, err, codeForbidden)
+	}
+}
+
+// readMarketerByTaxId returns the eId of the marketer holding taxId.
+func readMarketerByTaxId(cc *SimpleChaincode, stub *testStub, taxId string) (string, error) {
+	payload, err := cc.Query(stub, "marketerByTaxId", []string{taxId})
+	if err != nil {
+		return "", err
+	}
+	var envelope struct {
+		Record MarketerStruct `json:"record"`
+	}
+	err = json.Unmarshal(payload, &envelope)
+
+	return envelope.Record.EId, err
+}
+
+func TestTaxIdsAreUnique(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 1)
+	stub.mustInvoke(t, cc, "write", testPIIMarketer)
+
+	for _, call := range []struct{ function, arg string }{
+		{"write", `{"eId":"E3","taxId":"123456789","legalName":"Cy Diaz"}`},
+		{"updateMarketer", `{"eId":"E2","taxId":"123-45-6789"}`},
+	} {
+		if payload, err := stub.invoke(cc, call.function, call.arg); errorCode(err) != codeDuplicate {
+			t.Errorf("%s reusing the TaxId of E1: got %q, %v; want a %s error", call.function, payload, err, codeDuplicate)
+		}
+	}
+
+	// A marketer keeps its own TaxId, and frees it when deleted.
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E1","taxId":"123456789"}`)
+	stub.mustInvoke(t, cc, "deleteMarketer", "E1")
+	stub.mustInvoke(t, cc, "write", `{"eId":"E3","taxId":"123456789","legalName":"Cy Diaz"}`)
+}
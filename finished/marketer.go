@@ -0,0 +1,263 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// MarketerStatus values. A marketer starts Active and then moves between
+// states only through the transition functions below.
+const (
+	marketerActive     = "Active"
+	marketerSuspended  = "Suspended"
+	marketerTerminated = "Terminated"
+)
+
+// dateLayout is the ISO-8601 calendar date format used by every date field.
+const dateLayout = "2006-01-02"
+
+// marketerTransition describes one lifecycle invoke. MarketerEffectiveDate
+// always records when the current MarketerStatus took effect; MarketerEndDate
+// is set on termination and cleared again on reinstatement.
+type marketerTransition struct {
+	from     []string
+	to       string
+	done     string
+	setsEnd  bool
+	clearEnd bool
+}
+
+var marketerTransitions = map[string]marketerTransition{
+	"suspendMarketer":   {from: []string{marketerActive}, to: marketerSuspended, done: "suspended"},
+	"terminateMarketer": {from: []string{marketerActive, marketerSuspended}, to: marketerTerminated, done: "terminated", setsEnd: true},
+	"reinstateMarketer": {from: []string{marketerSuspended, marketerTerminated}, to: marketerActive, done: "reinstated", clearEnd: true},
+}
+
+// Fields that updateMarketer may not touch. The eId selects the record, the
+// status fields are owned by the lifecycle transitions and taxIdHash follows
+// the TaxId.
+var marketerImmutable = []string{"docType", "taxIdHash", "marketerStatus", "marketerEffectiveDate", "marketerEndDate"}
+
+// parseDate parses an ISO-8601 calendar date (YYYY-MM-DD).
+func parseDate(field, value string) (time.Time, error) {
+	date, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return time.Time{}, errorf(codeValidation, "%s must be a YYYY-MM-DD date, got %q", field, value).withField(field)
+	}
+
+	return date, nil
+}
+
+// getMarketer loads the marketer stored for eId.
+func getMarketer(stub shim.ChaincodeStubInterface, eId string) (string, MarketerStruct, error) {
+	var mktrStruct MarketerStruct
+
+	key, err := marketerKey(eId)
+	if err != nil {
+		return "", mktrStruct, err
+	}
+
+	err = getEntity(stub, marketerDocType, key, &mktrStruct)
+	return key, mktrStruct, err
+}
+
+// storeMarketer writes a marketer under key, replacing any existing record,
+// and keeps its lookup index entries in step. PII fields are sealed first.
+func storeMarketer(stub shim.ChaincodeStubInterface, key string, mktrStruct MarketerStruct) error {
+	var old *MarketerStruct
+	oldBytes, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if oldBytes != nil {
+		old = new(MarketerStruct)
+		if err = json.Unmarshal(oldBytes, old); err != nil {
+			return err
+		}
+	}
+
+	if err = sealMarketer(stub, &mktrStruct); err != nil {
+		return err
+	}
+	if err = setTaxIdHash(stub, &mktrStruct, old); err != nil {
+		return err
+	}
+	if err = checkTaxIdUnique(stub, mktrStruct.EId, mktrStruct.TaxIdHash); err != nil {
+		return err
+	}
+
+	mktrStruct.ObjectType = marketerDocType
+	mktrStructBytes, err := json.Marshal(mktrStruct)
+	if err != nil {
+		return err
+	}
+	if err = putEntity(stub, key, mktrStructBytes); err != nil {
+		return err
+	}
+
+	return reindexMarketer(stub, old, mktrStruct)
+}
+
+// updateMarketer - invoke function to change some fields of an existing
+// marketer. args[0] is a JSON object holding the eId and only the fields to
+// change; status and its dates go through the lifecycle functions instead.
+// The optional args[1] is the YYYY-MM-DD date the change takes effect,
+// defaulting to the transaction date.
+func (t *SimpleChaincode) updateMarketer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting 1 or 2")
+	}
+	date, err := changeDate(stub, args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodePatch(args[0], marketerImmutable)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := patchKeyFields(patch, "eId")
+	if err != nil {
+		return nil, err
+	}
+	eId := ids[0]
+
+	key, head, err := getMarketer(stub, eId)
+	if err != nil {
+		return nil, err
+	}
+	var mktrStruct MarketerStruct
+	ref := marketerRef(eId)
+	if err = baseVersion(stub, ref, head.MarketerEffectiveDate, date, &mktrStruct); err != nil {
+		return nil, err
+	}
+
+	if err = decodeStrict([]byte(args[0]), &mktrStruct); err != nil {
+		return nil, err
+	}
+	if err = checkOrg(stub, key, head.OrgName, mktrStruct.OrgName); err != nil {
+		return nil, err
+	}
+	if err = validate(&mktrStruct, marketerSchema); err != nil {
+		return nil, err
+	}
+	// A change pending until a later date only reaches storeMarketer then.
+	if err = setTaxIdHash(stub, &mktrStruct, &head); err != nil {
+		return nil, err
+	}
+	if err = checkTaxIdUnique(stub, mktrStruct.EId, mktrStruct.TaxIdHash); err != nil {
+		return nil, err
+	}
+
+	pending, err := commitVersion(stub, ref, date, &mktrStruct)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("*** successfully updated marketer " + eId)
+
+	return changeMessage("Marketer", "updated", date, pending), nil
+}
+
+// transitionMarketer - invoke function shared by suspendMarketer,
+// terminateMarketer and reinstateMarketer. Arguments are the eId and the
+// YYYY-MM-DD date the new status takes effect, which may not precede the
+// date the current status took effect. terminateMarketer takes an optional
+// reference policy for the marketer's assignments still active on that date.
+func (t *SimpleChaincode) transitionMarketer(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	transition, ok := marketerTransitions[function]
+	if !ok {
+		return nil, errorf(codeBadRequest, "Unknown marketer transition %s", function).withField("function")
+	}
+	policy := policyBlock
+	if transition.to == marketerTerminated && len(args) == 3 {
+		var err error
+		if policy, err = parseReferencePolicy(args, 2); err != nil {
+			return nil, err
+		}
+		args = args[:2]
+	}
+	if err := checkArgCount(args, 2); err != nil {
+		return nil, err
+	}
+
+	eId, effectiveDate := args[0], args[1]
+	date, err := parseDate("effectiveDate", effectiveDate)
+	if err != nil {
+		return nil, err
+	}
+
+	key, head, err := getMarketer(stub, eId)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkOrg(stub, key, head.OrgName); err != nil {
+		return nil, err
+	}
+	var mktrStruct MarketerStruct
+	ref := marketerRef(eId)
+	if err = baseVersion(stub, ref, head.MarketerEffectiveDate, effectiveDate, &mktrStruct); err != nil {
+		return nil, err
+	}
+
+	allowed := false
+	for _, from := range transition.from {
+		if strings.EqualFold(mktrStruct.MarketerStatus, from) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, errorf(codeConflict, "Invalid transition: cannot %s a marketer that is %q (allowed from %s)",
+			strings.TrimSuffix(function, "Marketer"), mktrStruct.MarketerStatus, strings.Join(transition.from, ", "))
+	}
+
+	if mktrStruct.MarketerEffectiveDate != "" {
+		current, err := parseDate("marketerEffectiveDate", mktrStruct.MarketerEffectiveDate)
+		if err == nil && date.Before(current) {
+			return nil, errorf(codeValidation, "effectiveDate %s precedes the current status date %s", effectiveDate, mktrStruct.MarketerEffectiveDate).withField("effectiveDate")
+		}
+	}
+
+	if transition.to == marketerTerminated {
+		assignments, err := marketerAssignments(stub, eId)
+		if err != nil {
+			return nil, err
+		}
+		if err = applyReferencePolicy(stub, "Marketer "+eId, assignments, effectiveDate, policy, false); err != nil {
+			return nil, err
+		}
+	}
+
+	mktrStruct.MarketerStatus = transition.to
+	mktrStruct.MarketerEffectiveDate = effectiveDate
+	if transition.setsEnd {
+		mktrStruct.MarketerEndDate = effectiveDate
+	}
+	if transition.clearEnd {
+		mktrStruct.MarketerEndDate = ""
+	}
+
+	pending, err := commitVersion(stub, ref, effectiveDate, &mktrStruct)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("*** marketer " + eId + " is now " + transition.to)
+
+	return changeMessage("Marketer", transition.done, effectiveDate, pending), nil
+}
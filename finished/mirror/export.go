@@ -0,0 +1,60 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	cloudant "github.com/IBM-Bluemix/go-cloudant"
+)
+
+// exportPageSize is the number of documents Export reads per query.
+const exportPageSize = 200
+
+// Export writes every mirrored record of a docType, such as marketer, to w
+// as one JSON document per line, without the CouchDB fields, and returns how
+// many it wrote. It follows the query's bookmarks, so the export is not
+// limited to one page.
+func Export(db *cloudant.DB, docType string, w io.Writer) (int, error) {
+	it := db.FindAll(cloudant.Query{
+		Selector: map[string]interface{}{"docType": docType},
+		Limit:    exportPageSize,
+	})
+
+	n := 0
+	encoder := json.NewEncoder(w)
+	for it.Next() {
+		var doc map[string]interface{}
+		if err := it.Decode(&doc); err != nil {
+			return n, fmt.Errorf("mirror: malformed document: %v", err)
+		}
+		for name := range doc {
+			if strings.HasPrefix(name, "_") {
+				delete(doc, name)
+			}
+		}
+		if err := encoder.Encode(doc); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := it.Err(); err != nil {
+		return n, fmt.Errorf("mirror: exporting %s records: %v", docType, err)
+	}
+
+	return n, nil
+}
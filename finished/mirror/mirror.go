@@ -0,0 +1,277 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mirror keeps a CouchDB database in step with the marketer, account
+// and assignment records of the chaincode, so that they can be searched
+// without querying peers.
+//
+// Each record is stored as one document whose _id is its ledger key, such as
+// MARKETER~E1. Changes arrive as entityChanges events (see docs/events.md);
+// for each change the mirror reads the record's current state from the
+// ledger and upserts it, so replaying events, or applying them late, always
+// converges on the ledger state. Resync rebuilds the whole database from the
+// chaincode's list queries.
+//
+// The mirror reads with whatever role its peer identity has, so an auditor
+// identity mirrors masked PII. Source and Store are interfaces, so the mirror
+// can run against a local CouchDB, or an in-memory stand-in for either side.
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	cloudant "github.com/IBM-Bluemix/go-cloudant"
+	couchdb "github.com/timjacobi/go-couchdb"
+)
+
+// Change is one entry of an entityChanges event.
+type Change struct {
+	Type          string   `json:"type"`
+	Key           string   `json:"key"`
+	Change        string   `json:"change"`
+	ChangedFields []string `json:"changedFields"`
+}
+
+// Event is the payload of the chaincode's entityChanges event.
+type Event struct {
+	Schema    string   `json:"schema"`
+	TxID      string   `json:"txId"`
+	Timestamp string   `json:"timestamp"`
+	Changes   []Change `json:"changes"`
+}
+
+// EventSchema is the event schema version the mirror understands.
+const EventSchema = "entityChanges/v1"
+
+// Source reads chaincode state.
+type Source interface {
+	// Read returns the record stored under key, or nil if there is none.
+	Read(key string) (json.RawMessage, error)
+	// List returns one page of the records of a list query, such as
+	// listMarketers, and the token of the next page, "" on the last.
+	List(function string, args []string, token string) ([]json.RawMessage, string, error)
+}
+
+// Store is the part of cloudant.DB the mirror writes through.
+type Store interface {
+	GetDocument(id string, doc interface{}, opts cloudant.Options) error
+	CreateDocument(doc interface{}) (string, string, error)
+	UpdateDocument(id string, rev string, doc interface{}) (string, error)
+	DeleteDocument(id string, rev string) (string, error)
+	GetAllDocument(result interface{}, opts cloudant.Options) error
+}
+
+// maxConflictRetries bounds the retries of a write that lost a race with
+// another writer of the same document.
+const maxConflictRetries = 3
+
+// Mirror copies ledger records from Source to Store.
+type Mirror struct {
+	Source Source
+	Store  Store
+}
+
+// Stats counts what an Apply or Resync did.
+type Stats struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Deleted   int `json:"deleted"`
+}
+
+func (s *Stats) add(other Stats) {
+	s.Created += other.Created
+	s.Updated += other.Updated
+	s.Unchanged += other.Unchanged
+	s.Deleted += other.Deleted
+}
+
+// Apply mirrors the records named by an entityChanges event.
+func (m *Mirror) Apply(event Event) (Stats, error) {
+	var stats Stats
+	if event.Schema != EventSchema {
+		return stats, fmt.Errorf("mirror: unsupported event schema %q", event.Schema)
+	}
+
+	for _, change := range event.Changes {
+		record, err := m.Source.Read(change.Key)
+		if err != nil {
+			return stats, fmt.Errorf("mirror: reading %s: %v", change.Key, err)
+		}
+		changeStats, err := m.Put(change.Key, record)
+		if err != nil {
+			return stats, err
+		}
+		stats.add(changeStats)
+	}
+
+	return stats, nil
+}
+
+// Put makes the document key hold record, or deletes it when record is nil.
+// Writing a record the document already holds changes nothing, so the
+// revision only moves when the record does.
+func (m *Mirror) Put(key string, record json.RawMessage) (Stats, error) {
+	var stats Stats
+	var fields map[string]interface{}
+	if record != nil {
+		if err := json.Unmarshal(record, &fields); err != nil {
+			return stats, fmt.Errorf("mirror: record %s is not a JSON object: %v", key, err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		var current map[string]interface{}
+		err := m.Store.GetDocument(key, &current, nil)
+		if err != nil && !couchdb.NotFound(err) {
+			return stats, fmt.Errorf("mirror: reading document %s: %v", key, err)
+		}
+		found := err == nil
+		rev, _ := current["_rev"].(string)
+
+		switch {
+		case fields == nil && !found:
+			stats.Unchanged++
+			return stats, nil
+		case fields == nil:
+			_, err = m.Store.DeleteDocument(key, rev)
+			if err == nil || couchdb.NotFound(err) {
+				stats.Deleted++
+				return stats, nil
+			}
+		case found && sameRecord(current, fields):
+			stats.Unchanged++
+			return stats, nil
+		case found:
+			fields["_id"] = key
+			_, err = m.Store.UpdateDocument(key, rev, fields)
+			if err == nil {
+				stats.Updated++
+				return stats, nil
+			}
+		default:
+			fields["_id"] = key
+			_, _, err = m.Store.CreateDocument(fields)
+			if err == nil {
+				stats.Created++
+				return stats, nil
+			}
+		}
+		delete(fields, "_id")
+
+		if !couchdb.Conflict(err) || attempt == maxConflictRetries {
+			return stats, fmt.Errorf("mirror: writing document %s: %v", key, err)
+		}
+	}
+}
+
+// sameRecord reports whether a stored document holds record, ignoring the
+// document's CouchDB fields.
+func sameRecord(doc, record map[string]interface{}) bool {
+	stripped := make(map[string]interface{}, len(doc))
+	for name, value := range doc {
+		if !strings.HasPrefix(name, "_") {
+			stripped[name] = value
+		}
+	}
+
+	return reflect.DeepEqual(stripped, record)
+}
+
+// recordIds holds the fields that make up the ledger keys of records.
+type recordIds struct {
+	EId           string `json:"eId"`
+	PolicyPrefix  string `json:"policyPrefix"`
+	AccountNumber string `json:"accountNumber"`
+	AssignmentId  string `json:"assignmentId"`
+}
+
+// resyncQueries are the list queries that together return every record,
+// with the function building each record's ledger key.
+var resyncQueries = []struct {
+	function string
+	args     []string
+	key      func(ids recordIds) string
+}{
+	{"listMarketers", nil, func(ids recordIds) string {
+		return "MARKETER~" + ids.EId
+	}},
+	{"listAccounts", []string{""}, func(ids recordIds) string {
+		return "ACCOUNT~" + ids.PolicyPrefix + "~" + ids.AccountNumber
+	}},
+	{"listAssignments", nil, func(ids recordIds) string {
+		return "ASSIGNMENT~" + ids.AssignmentId
+	}},
+}
+
+// Resync upserts every record the list queries return and, when prune is
+// set, deletes the documents of records no longer on the ledger.
+func (m *Mirror) Resync(prune bool) (Stats, error) {
+	var stats Stats
+	seen := map[string]bool{}
+
+	for _, query := range resyncQueries {
+		token := ""
+		for {
+			records, next, err := m.Source.List(query.function, query.args, token)
+			if err != nil {
+				return stats, fmt.Errorf("mirror: %s: %v", query.function, err)
+			}
+			for _, record := range records {
+				var ids recordIds
+				if err = json.Unmarshal(record, &ids); err != nil {
+					return stats, fmt.Errorf("mirror: %s returned a malformed record: %v", query.function, err)
+				}
+				key := query.key(ids)
+				putStats, err := m.Put(key, record)
+				if err != nil {
+					return stats, err
+				}
+				stats.add(putStats)
+				seen[key] = true
+			}
+			if next == "" {
+				break
+			}
+			token = next
+		}
+	}
+
+	if !prune {
+		return stats, nil
+	}
+
+	var all struct {
+		Rows []struct {
+			ID string `json:"id"`
+		} `json:"rows"`
+	}
+	if err := m.Store.GetAllDocument(&all, nil); err != nil {
+		return stats, fmt.Errorf("mirror: listing documents: %v", err)
+	}
+	for _, row := range all.Rows {
+		if seen[row.ID] || strings.HasPrefix(row.ID, "_design/") {
+			continue
+		}
+		putStats, err := m.Put(row.ID, nil)
+		if err != nil {
+			return stats, err
+		}
+		stats.add(putStats)
+	}
+
+	return stats, nil
+}
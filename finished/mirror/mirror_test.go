@@ -0,0 +1,304 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	cloudant "github.com/IBM-Bluemix/go-cloudant"
+	couchdb "github.com/timjacobi/go-couchdb"
+)
+
+// memStore is an in-memory Store that checks revisions as CouchDB does.
+type memStore struct {
+	docs map[string]map[string]interface{}
+	revs int
+
+	// conflicts makes the next writes of a document fail with a conflict,
+	// as if another writer had changed it first.
+	conflicts map[string]int
+}
+
+func newMemStore() *memStore {
+	return &memStore{docs: map[string]map[string]interface{}{}, conflicts: map[string]int{}}
+}
+
+func storeError(status int, id string) error {
+	return &couchdb.Error{StatusCode: status, URL: id, ErrorCode: http.StatusText(status)}
+}
+
+// put stores doc under id with a new revision.
+func (s *memStore) put(id string, doc map[string]interface{}) string {
+	s.revs++
+	rev := fmt.Sprintf("%d-mem", s.revs)
+	stored := map[string]interface{}{}
+	for name, value := range doc {
+		stored[name] = value
+	}
+	stored["_id"], stored["_rev"] = id, rev
+	s.docs[id] = stored
+
+	return rev
+}
+
+// write checks rev against the stored revision and takes up a pending
+// conflict, which also moves the stored revision on.
+func (s *memStore) write(id, rev string) error {
+	current, found := s.docs[id]
+	if s.conflicts[id] > 0 {
+		s.conflicts[id]--
+		if found {
+			s.put(id, current)
+		}
+		return storeError(http.StatusConflict, id)
+	}
+	if found && current["_rev"] != rev {
+		return storeError(http.StatusConflict, id)
+	}
+
+	return nil
+}
+
+func (s *memStore) GetDocument(id string, doc interface{}, opts cloudant.Options) error {
+	stored, ok := s.docs[id]
+	if !ok {
+		return storeError(http.StatusNotFound, id)
+	}
+	docBytes, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(docBytes, doc)
+}
+
+func (s *memStore) CreateDocument(doc interface{}) (string, string, error) {
+	fields := doc.(map[string]interface{})
+	id := fields["_id"].(string)
+	if _, ok := s.docs[id]; ok {
+		return "", "", storeError(http.StatusConflict, id)
+	}
+	if err := s.write(id, ""); err != nil {
+		return "", "", err
+	}
+
+	return id, s.put(id, fields), nil
+}
+
+func (s *memStore) UpdateDocument(id string, rev string, doc interface{}) (string, error) {
+	if _, ok := s.docs[id]; !ok {
+		return "", storeError(http.StatusNotFound, id)
+	}
+	if err := s.write(id, rev); err != nil {
+		return "", err
+	}
+
+	return s.put(id, doc.(map[string]interface{})), nil
+}
+
+func (s *memStore) DeleteDocument(id string, rev string) (string, error) {
+	if _, ok := s.docs[id]; !ok {
+		return "", storeError(http.StatusNotFound, id)
+	}
+	if err := s.write(id, rev); err != nil {
+		return "", err
+	}
+	delete(s.docs, id)
+
+	return rev, nil
+}
+
+func (s *memStore) GetAllDocument(result interface{}, opts cloudant.Options) error {
+	type row struct {
+		ID string `json:"id"`
+	}
+	var all struct {
+		Rows []row `json:"rows"`
+	}
+	for id := range s.docs {
+		all.Rows = append(all.Rows, row{id})
+	}
+	allBytes, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(allBytes, result)
+}
+
+// memSource is a Source over records held by ledger key. List returns one
+// record per page, to exercise paging.
+type memSource map[string]string
+
+var listPrefixes = map[string]string{
+	"listMarketers":   "MARKETER~",
+	"listAccounts":    "ACCOUNT~",
+	"listAssignments": "ASSIGNMENT~",
+}
+
+func (s memSource) Read(key string) (json.RawMessage, error) {
+	record, ok := s[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return json.RawMessage(record), nil
+}
+
+func (s memSource) List(function string, args []string, token string) ([]json.RawMessage, string, error) {
+	var keys []string
+	for key := range s {
+		if strings.HasPrefix(key, listPrefixes[function]) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	page := 0
+	if token != "" {
+		var err error
+		if page, err = strconv.Atoi(token); err != nil {
+			return nil, "", err
+		}
+	}
+	if page >= len(keys) {
+		return nil, "", nil
+	}
+	next := ""
+	if page+1 < len(keys) {
+		next = strconv.Itoa(page + 1)
+	}
+
+	return []json.RawMessage{json.RawMessage(s[keys[page]])}, next, nil
+}
+
+var testRecords = memSource{
+	"MARKETER~E1":     `{"docType":"marketer","eId":"E1","legalName":"Ann Lee"}`,
+	"MARKETER~E2":     `{"docType":"marketer","eId":"E2","legalName":"Bo Chen"}`,
+	"ACCOUNT~P~A1":    `{"docType":"account","version":1,"policyPrefix":"P","accountNumber":"A1"}`,
+	"ASSIGNMENT~S1":   `{"docType":"assignment","version":1,"assignmentId":"S1","eId":"E1"}`,
+	"ASSIGNMENT~S2":   `{"docType":"assignment","version":2,"assignmentId":"S2","eId":"E2"}`,
+	"MARKETER~E3":     `{"docType":"marketer","eId":"E3","legalName":"Cy Diaz"}`,
+	"ACCOUNT~P~A2":    `{"docType":"account","version":3,"policyPrefix":"P","accountNumber":"A2"}`,
+	"ASSIGNMENT~S100": `{"docType":"assignment","version":1,"assignmentId":"S100","eId":"E3"}`,
+}
+
+func TestApply(t *testing.T) {
+	store := newMemStore()
+	store.put("ASSIGNMENT~S9", map[string]interface{}{"docType": "assignment", "assignmentId": "S9"})
+	m := &Mirror{Source: testRecords, Store: store}
+
+	event := Event{Schema: EventSchema, Changes: []Change{
+		{Type: "marketer", Key: "MARKETER~E1", Change: "create"},
+		{Type: "assignment", Key: "ASSIGNMENT~S9", Change: "delete"},
+	}}
+	stats, err := m.Apply(event)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if want := (Stats{Created: 1, Deleted: 1}); stats != want {
+		t.Errorf("Apply: got %+v, want %+v", stats, want)
+	}
+	if doc := store.docs["MARKETER~E1"]; doc == nil || doc["legalName"] != "Ann Lee" {
+		t.Errorf("Apply stored %v for MARKETER~E1", doc)
+	}
+	if _, ok := store.docs["ASSIGNMENT~S9"]; ok {
+		t.Error("Apply left the deleted ASSIGNMENT~S9")
+	}
+
+	// Replaying the event finds nothing to do.
+	rev := store.docs["MARKETER~E1"]["_rev"]
+	if stats, err = m.Apply(event); err != nil || stats != (Stats{Unchanged: 2}) {
+		t.Errorf("Apply again: got %+v, %v, want %+v", stats, err, Stats{Unchanged: 2})
+	}
+	if store.docs["MARKETER~E1"]["_rev"] != rev {
+		t.Error("Apply again moved the revision of an unchanged document")
+	}
+
+	if _, err = m.Apply(Event{Schema: "entityChanges/v0"}); err == nil {
+		t.Error("Apply accepted an unknown event schema")
+	}
+}
+
+func TestPutRetriesConflicts(t *testing.T) {
+	store := newMemStore()
+	store.put("MARKETER~E1", map[string]interface{}{"docType": "marketer", "eId": "E1", "legalName": "Old"})
+	m := &Mirror{Source: testRecords, Store: store}
+	record := json.RawMessage(testRecords["MARKETER~E1"])
+
+	store.conflicts["MARKETER~E1"] = maxConflictRetries
+	stats, err := m.Put("MARKETER~E1", record)
+	if err != nil || stats != (Stats{Updated: 1}) {
+		t.Fatalf("Put after %d conflicts: got %+v, %v, want %+v", maxConflictRetries, stats, err, Stats{Updated: 1})
+	}
+	if doc := store.docs["MARKETER~E1"]; doc["legalName"] != "Ann Lee" {
+		t.Errorf("Put stored %v", doc)
+	}
+
+	store.conflicts["MARKETER~E2"] = 1
+	if stats, err = m.Put("MARKETER~E2", json.RawMessage(testRecords["MARKETER~E2"])); err != nil || stats != (Stats{Created: 1}) {
+		t.Errorf("Put of a new document after a conflict: got %+v, %v, want %+v", stats, err, Stats{Created: 1})
+	}
+
+	store.conflicts["MARKETER~E1"] = maxConflictRetries + 1
+	if _, err = m.Put("MARKETER~E1", json.RawMessage(`{"docType":"marketer","eId":"E1","legalName":"New"}`)); err == nil {
+		t.Errorf("Put after %d conflicts succeeded", maxConflictRetries+1)
+	}
+	if doc := store.docs["MARKETER~E1"]; doc["legalName"] != "Ann Lee" {
+		t.Errorf("Put that gave up stored %v", doc)
+	}
+}
+
+func TestResync(t *testing.T) {
+	store := newMemStore()
+	store.put("MARKETER~E1", map[string]interface{}{"docType": "marketer", "eId": "E1", "legalName": "Ann Lee"})
+	store.put("MARKETER~GONE", map[string]interface{}{"docType": "marketer", "eId": "GONE"})
+	store.put("_design/search", map[string]interface{}{"language": "javascript"})
+	m := &Mirror{Source: testRecords, Store: store}
+
+	stats, err := m.Resync(false)
+	if err != nil {
+		t.Fatalf("Resync failed: %v", err)
+	}
+	if want := (Stats{Created: len(testRecords) - 1, Unchanged: 1}); stats != want {
+		t.Errorf("Resync: got %+v, want %+v", stats, want)
+	}
+	for key := range testRecords {
+		if _, ok := store.docs[key]; !ok {
+			t.Errorf("Resync did not store %s", key)
+		}
+	}
+	if _, ok := store.docs["MARKETER~GONE"]; !ok {
+		t.Error("Resync without prune deleted MARKETER~GONE")
+	}
+
+	if stats, err = m.Resync(true); err != nil {
+		t.Fatalf("Resync with prune failed: %v", err)
+	}
+	if want := (Stats{Unchanged: len(testRecords), Deleted: 1}); stats != want {
+		t.Errorf("Resync with prune: got %+v, want %+v", stats, want)
+	}
+	if _, ok := store.docs["MARKETER~GONE"]; ok {
+		t.Error("Resync with prune kept MARKETER~GONE")
+	}
+	if _, ok := store.docs["_design/search"]; !ok {
+		t.Error("Resync with prune deleted a design document")
+	}
+}
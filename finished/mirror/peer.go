@@ -0,0 +1,131 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// PeerSource reads chaincode state through the /chaincode JSON-RPC endpoint
+// of a peer's REST API.
+type PeerSource struct {
+	URL         string // peer REST address, e.g. http://localhost:7050
+	ChaincodeID string // the chaincode's deployment name
+	User        string // enrolled user the queries run as
+	Client      *http.Client
+}
+
+type rpcRequest struct {
+	JSONRPC string    `json:"jsonrpc"`
+	Method  string    `json:"method"`
+	Params  rpcParams `json:"params"`
+	ID      int       `json:"id"`
+}
+
+type rpcParams struct {
+	Type        int `json:"type"`
+	ChaincodeID struct {
+		Name string `json:"name"`
+	} `json:"chaincodeID"`
+	CtorMsg struct {
+		Function string   `json:"function"`
+		Args     []string `json:"args"`
+	} `json:"ctorMsg"`
+	SecureContext string `json:"secureContext,omitempty"`
+}
+
+type rpcResponse struct {
+	Result *struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	} `json:"result"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Data    string `json:"data"`
+	} `json:"error"`
+}
+
+// query runs a chaincode query and returns its payload.
+func (p *PeerSource) query(function string, args []string) ([]byte, error) {
+	req := rpcRequest{JSONRPC: "2.0", Method: "query", ID: 1}
+	req.Params.Type = 1
+	req.Params.ChaincodeID.Name = p.ChaincodeID
+	req.Params.CtorMsg.Function = function
+	req.Params.CtorMsg.Args = args
+	if req.Params.CtorMsg.Args == nil {
+		req.Params.CtorMsg.Args = []string{}
+	}
+	req.Params.SecureContext = p.User
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(strings.TrimRight(p.URL, "/")+"/chaincode", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var reply rpcResponse
+	if err = json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("peer returned %s: %v", resp.Status, err)
+	}
+	if reply.Error != nil {
+		return nil, fmt.Errorf("%s query failed: %s %s", function, reply.Error.Message, reply.Error.Data)
+	}
+	if reply.Result == nil {
+		return nil, fmt.Errorf("%s query returned no result", function)
+	}
+
+	return []byte(reply.Result.Message), nil
+}
+
+// Read returns the record stored under key, or nil if there is none.
+func (p *PeerSource) Read(key string) (json.RawMessage, error) {
+	payload, err := p.query("read", []string{key})
+	if err != nil || len(bytes.TrimSpace(payload)) == 0 {
+		return nil, err
+	}
+
+	return json.RawMessage(payload), nil
+}
+
+// List returns one page of a list query.
+func (p *PeerSource) List(function string, args []string, token string) ([]json.RawMessage, string, error) {
+	args = append(append([]string{}, args...), "", token)
+	payload, err := p.query(function, args)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var page struct {
+		Records   []json.RawMessage `json:"records"`
+		NextToken string            `json:"nextToken"`
+	}
+	if err = json.Unmarshal(payload, &page); err != nil {
+		return nil, "", fmt.Errorf("%s returned a malformed page: %v", function, err)
+	}
+
+	return page.Records, page.NextToken, nil
+}
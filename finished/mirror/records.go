@@ -0,0 +1,142 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cloudant "github.com/IBM-Bluemix/go-cloudant"
+)
+
+// MarketerStruct, AccountStruct and AssignmentStruct are the mirrored
+// documents of the chaincode's records of the same names. Their JSON must
+// stay in step with the chaincode's.
+type MarketerStruct struct {
+	ObjectType            string `json:"docType"`
+	EId                   string `json:"eId"`
+	TaxId                 string `json:"taxId"`
+	TaxIdHash             string `json:"taxIdHash,omitempty"`
+	BeginDate             string `json:"beginDate"`
+	MarketerTypeFlag      string `json:"marketerTypeFlag"`
+	MarketerType          string `json:"marketerType"`
+	MarketerRole          string `json:"marketerRole"`
+	MarketerStatus        string `json:"marketerStatus"`
+	LegalName             string `json:"legalName"`
+	Gender                string `json:"gender"`
+	DoB                   string `json:"doB"`
+	RegStateName          string `json:"regStateName"`
+	MarketerEffectiveDate string `json:"marketerEffectiveDate"`
+	MarketerEndDate       string `json:"marketerEndDate"`
+	FirstName             string `json:"firstName"`
+	LastName              string `json:"lastName"`
+	BusinessAddress       string `json:"businessAddress"`
+	City                  string `json:"city"`
+	State                 string `json:"state"`
+	PostalCode            string `json:"postalCode"`
+	PhoneNumber           string `json:"phoneNumber"`
+	EMail                 string `json:"eMail"`
+	MarketerEaRole        string `json:"marketerEaRole"`
+	OwnerRole             string `json:"ownerRole"`
+	OrgName               string `json:"orgName"`
+}
+
+type AccountStruct struct {
+	ObjectType                 string `json:"docType"`
+	Version                    int    `json:"version"`
+	AccountNumber              string `json:"accountNumber"`
+	PolicyPrefix               string `json:"policyPrefix"`
+	InternalAccountName        string `json:"internalAccountName"`
+	AccountStatus              string `json:"accountStatus"`
+	AccountStatusEffectiveDate string `json:"accountStatusEffectiveDate"`
+	ValidationStatus           string `json:"validationStatus"`
+	AccountEffectiveDate       string `json:"accountEffectiveDate"`
+	MarketerProduct            string `json:"marketerProduct"`
+	DisclosureStatus           string `json:"disclosureStatus"`
+	DisclosureEffectiveDate    string `json:"disclosureEffectiveDate"`
+	OrgName                    string `json:"orgName,omitempty"`
+}
+
+type AssignmentStruct struct {
+	ObjectType              string `json:"docType"`
+	Version                 int    `json:"version"`
+	AssignmentId            string `json:"assignmentId"`
+	AssignmentRoleType      string `json:"assignmentRoleType"`
+	SplitPercentage         string `json:"splitPercentage"`
+	AssignmentEffectiveDate string `json:"assignmentEffectiveDate"`
+	AssignmentStatus        string `json:"assignmentStatus"`
+	AssignmentEndDate       string `json:"assignmentEndDate"`
+	SplitEffectiveDate      string `json:"splitEffectiveDate"`
+	OwnerEId                string `json:"ownerEId"`
+	OwnerRole               string `json:"ownerRole"`
+	OrgName                 string `json:"orgName"`
+	PolicyPrefix            string `json:"policyPrefix"`
+	AccountNumber           string `json:"accountNumber"`
+	EId                     string `json:"eId"`
+}
+
+// RecordTypes maps each docType to the struct its documents decode into.
+var RecordTypes = map[string]func() interface{}{
+	"marketer":   func() interface{} { return new(MarketerStruct) },
+	"account":    func() interface{} { return new(AccountStruct) },
+	"assignment": func() interface{} { return new(AssignmentStruct) },
+}
+
+// NewConsumer returns a consumer of the mirror database's changes feed that
+// decodes each record into a *MarketerStruct, *AccountStruct or
+// *AssignmentStruct, resuming from checkpoint if it is not nil.
+func NewConsumer(db *cloudant.DB, checkpoint cloudant.Checkpoint) *cloudant.ChangesConsumer {
+	return &cloudant.ChangesConsumer{
+		DB:         db,
+		Checkpoint: checkpoint,
+		TypeField:  "docType",
+		Types:      RecordTypes,
+	}
+}
+
+// FileCheckpoint keeps a changes feed sequence in the file it names.
+type FileCheckpoint string
+
+// Load returns the saved sequence, or "" if the file does not exist.
+func (f FileCheckpoint) Load() (string, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	return strings.TrimSpace(string(data)), err
+}
+
+// Save replaces the saved sequence. The file is replaced by a rename, so a
+// crash never leaves it half written.
+func (f FileCheckpoint) Save(seq string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(string(f)), filepath.Base(string(f))+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(seq + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), string(f))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
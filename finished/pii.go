@@ -0,0 +1,442 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// The marketer PII fields are stored sealed under a 256-bit PII key whose
+// SHA-256 fingerprint Init is given. Only the fingerprint is written to the
+// world state; callers pass the key itself in the transaction metadata as
+//
+//	{"piiKey":"<base64 key>"}
+//
+// Fabric v0.6 keeps that metadata in the transaction, and so in the blocks
+// of the ledger, of every invoke and query that carries it. Anyone who can
+// read the blocks can recover the key unless the network runs with
+// confidentiality (security.privacy) enabled, which encrypts transactions.
+// Send the key only when a function needs it, keep block access as narrow
+// as the PII itself, and treat the key as exposed if either is in doubt.
+// The fingerprint cannot be replaced once set, so an exposed key means
+// deploying afresh with a new one.
+//
+// A sealed value reads enc:v1:<mask>:<base64 nonce+ciphertext>. It is
+// AES-256-GCM with the eId and field name as additional data. The nonce is
+// an HMAC of the same inputs and the plaintext, so every peer produces the
+// same ciphertext; the cost is that equal values of one field of one
+// marketer seal identically.
+//
+// Values stay sealed in memory unless the caller supplied the key, so
+// functions that only copy a record work without it. Writing a new plaintext
+// value needs the key. Query results show plaintext only to admins and to
+// writers of the marketer's org; everyone else gets the mask.
+const (
+	sealedPrefix = "enc:v1:"
+
+	piiConfigKey  = configKeyType + keySeparator + "piiKeyFingerprint"
+	piiKeyMetaTag = "piiKey"
+	piiKeySize    = 32
+)
+
+// piiField points at one PII field of a marketer, named as in its JSON.
+type piiField struct {
+	name  string
+	value *string
+}
+
+func piiFields(mktrStruct *MarketerStruct) []piiField {
+	return []piiField{
+		{"taxId", &mktrStruct.TaxId},
+		{"doB", &mktrStruct.DoB},
+		{"gender", &mktrStruct.Gender},
+		{"eMail", &mktrStruct.EMail},
+		{"phoneNumber", &mktrStruct.PhoneNumber},
+	}
+}
+
+// isPIIField reports whether name is the json name of a marketer PII field.
+func isPIIField(name string) bool {
+	for _, field := range piiFields(&MarketerStruct{}) {
+		if field.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// splitSealed returns the mask and the decoded nonce and ciphertext of a
+// sealed value, and false when value only looks sealed.
+func splitSealed(value string) (string, []byte, bool) {
+	body := strings.TrimPrefix(value, sealedPrefix)
+	sep := strings.LastIndex(body, ":")
+	if sep < 0 {
+		return "", nil, false
+	}
+	sealed, err := base64.StdEncoding.DecodeString(body[sep+1:])
+	if err != nil || len(sealed) == 0 {
+		return "", nil, false
+	}
+
+	return body[:sep], sealed, true
+}
+
+// sealedMask returns the mask stored in a sealed value of field, or the
+// field's blank mask when the value is malformed.
+func sealedMask(field, value string) string {
+	mask, _, ok := splitSealed(value)
+	if !ok {
+		return maskPII(field, "")
+	}
+
+	return mask
+}
+
+// lastDigits returns the last n digits of value, or "" if it has fewer.
+func lastDigits(value string, n int) string {
+	var digits []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] >= '0' && value[i] <= '9' {
+			digits = append(digits, value[i])
+		}
+	}
+	if len(digits) < n {
+		return ""
+	}
+
+	return string(digits[len(digits)-n:])
+}
+
+// maskPII returns what unauthorized readers see instead of a PII value.
+func maskPII(field, value string) string {
+	switch field {
+	case "taxId":
+		if last := lastDigits(value, 4); last != "" {
+			return "***-**-" + last
+		}
+		return "***-**-****"
+	case "phoneNumber":
+		if last := lastDigits(value, 4); last != "" {
+			return "***-***-" + last
+		}
+		return "***-***-****"
+	case "eMail":
+		if at := strings.LastIndex(value, "@"); at > 0 {
+			return value[:1] + "***" + value[at:]
+		}
+		return "***"
+	case "doB":
+		return "****-**-**"
+	}
+
+	return "*"
+}
+
+// piiFingerprint returns the PII key fingerprint set by Init, "" when PII
+// sealing is not configured.
+func piiFingerprint(stub shim.ChaincodeStubInterface) (string, error) {
+	fingerprint, err := stub.GetState(piiConfigKey)
+	if err != nil {
+		return "", err
+	}
+
+	return string(fingerprint), nil
+}
+
+// setPIIFingerprint stores the hex SHA-256 fingerprint of the PII key. A
+// fingerprint already set may not be replaced, since that would leave the
+// values sealed under the old key unreadable; setting the same one again is
+// a no-op.
+func setPIIFingerprint(stub shim.ChaincodeStubInterface, fingerprint string) error {
+	if raw, err := hex.DecodeString(fingerprint); err != nil || len(raw) != sha256.Size {
+		return newError(codeBadRequest, "PII key fingerprint must be a hex SHA-256 digest").withField("piiKeyFingerprint")
+	}
+	fingerprint = strings.ToLower(fingerprint)
+
+	current, err := piiFingerprint(stub)
+	if err != nil {
+		return err
+	}
+	if current == fingerprint {
+		return nil
+	}
+	if current != "" {
+		return newError(codeConflict, "PII key fingerprint is already set and cannot be replaced").withField("piiKeyFingerprint").withKey(piiConfigKey)
+	}
+
+	return stub.PutState(piiConfigKey, []byte(fingerprint))
+}
+
+// piiKey returns the PII key from the transaction metadata, or nil when the
+// caller supplied none or PII sealing is not configured.
+func piiKey(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fingerprint, err := piiFingerprint(stub)
+	if err != nil || fingerprint == "" {
+		return nil, err
+	}
+
+	metadata, err := stub.GetCallerMetadata()
+	if err != nil || len(bytes.TrimSpace(metadata)) == 0 {
+		return nil, nil
+	}
+	var meta map[string]string
+	if err = json.Unmarshal(metadata, &meta); err != nil || meta[piiKeyMetaTag] == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(meta[piiKeyMetaTag])
+	if err != nil || len(key) != piiKeySize {
+		return nil, newError(codeBadRequest, "piiKey must be a base64 encoded 256-bit key").withField(piiKeyMetaTag)
+	}
+	sum := sha256.Sum256(key)
+	if hex.EncodeToString(sum[:]) != fingerprint {
+		return nil, newError(codeForbidden, "piiKey does not match the configured fingerprint").withField(piiKeyMetaTag)
+	}
+
+	return key, nil
+}
+
+// requirePIIKey returns the PII key from the transaction metadata and fails
+// when PII sealing is not configured or the caller supplied no key. what
+// names the operation needing the key and field the argument it is about,
+// if any.
+func requirePIIKey(stub shim.ChaincodeStubInterface, what, field string) ([]byte, error) {
+	fingerprint, err := piiFingerprint(stub)
+	if err != nil {
+		return nil, err
+	}
+	if fingerprint == "" {
+		return nil, newError(codeForbidden, what+" requires PII sealing to be configured by Init").withField(field)
+	}
+	key, err := piiKey(stub)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, newError(codeForbidden, what+" requires the piiKey in the transaction metadata").withField(field)
+	}
+
+	return key, nil
+}
+
+func piiAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealValue encrypts one PII value of marketer eId.
+func sealValue(key []byte, eId, field, value string) (string, error) {
+	aead, err := piiAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	aad := []byte(eId + "\x00" + field)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(aad)
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), aad)
+	return sealedPrefix + maskPII(field, value) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openValue decrypts a value produced by sealValue.
+func openValue(key []byte, eId, field, value string) (string, error) {
+	aead, err := piiAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	_, sealed, ok := splitSealed(value)
+	if !ok || len(sealed) < aead.NonceSize() {
+		return "", errorf(codeInternal, "Corrupt sealed %s for marketer %s", field, eId)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(eId+"\x00"+field))
+	if err != nil {
+		return "", errorf(codeInternal, "Cannot decrypt %s for marketer %s", field, eId)
+	}
+
+	return string(plain), nil
+}
+
+// sealMarketer seals the plaintext PII fields of a marketer about to be
+// stored, after hashing its TaxId for the index. Values already sealed can
+// only have been loaded from state, as input holding one is rejected, and
+// are kept as they are. Stored values that only look sealed, such as those
+// of records written before sealing, are rejected.
+func sealMarketer(stub shim.ChaincodeStubInterface, mktrStruct *MarketerStruct) error {
+	for _, field := range piiFields(mktrStruct) {
+		if _, _, ok := splitSealed(*field.value); isSealed(*field.value) && !ok {
+			return errorf(codeInternal, "Corrupt sealed %s for marketer %s", field.name, mktrStruct.EId).withField(field.name)
+		}
+	}
+	if err := setTaxIdHash(stub, mktrStruct, nil); err != nil {
+		return err
+	}
+
+	fingerprint, err := piiFingerprint(stub)
+	if err != nil || fingerprint == "" {
+		return err
+	}
+	key, err := piiKey(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range piiFields(mktrStruct) {
+		if *field.value == "" || isSealed(*field.value) {
+			continue
+		}
+		if key == nil {
+			return errorf(codeForbidden, "Writing %s requires the piiKey in the transaction metadata", field.name).withField(field.name)
+		}
+		if *field.value, err = sealValue(key, mktrStruct.EId, field.name, *field.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openMarketer decrypts the sealed PII fields of a loaded marketer when the
+// caller supplied the key, and leaves them sealed otherwise.
+func openMarketer(stub shim.ChaincodeStubInterface, mktrStruct *MarketerStruct) error {
+	key, err := piiKey(stub)
+	if err != nil || key == nil {
+		return err
+	}
+
+	for _, field := range piiFields(mktrStruct) {
+		if !isSealed(*field.value) {
+			continue
+		}
+		if *field.value, err = openValue(key, mktrStruct.EId, field.name, *field.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// presentMarketer prepares a marketer for a query result: callers not
+// allowed to see its PII get masks, as does anyone for values still sealed.
+func presentMarketer(stub shim.ChaincodeStubInterface, mktrStruct *MarketerStruct) {
+	authorized := roleRank[callerAttr(stub, roleAttribute)] >= roleRank[roleWriter] &&
+		checkOrg(stub, "", mktrStruct.OrgName) == nil
+
+	if !authorized {
+		mktrStruct.TaxIdHash = ""
+	}
+	for _, field := range piiFields(mktrStruct) {
+		switch {
+		case isSealed(*field.value):
+			*field.value = sealedMask(field.name, *field.value)
+		case !authorized && *field.value != "":
+			*field.value = maskPII(field.name, *field.value)
+		}
+	}
+}
+
+// openRecord applies openMarketer to marketers loaded through a generic record.
+func openRecord(stub shim.ChaincodeStubInterface, record interface{}) error {
+	if mktrStruct, ok := record.(*MarketerStruct); ok {
+		return openMarketer(stub, mktrStruct)
+	}
+
+	return nil
+}
+
+// sealRecord returns the record to store for a generic record pointer,
+// sealing a copy of marketers.
+func sealRecord(stub shim.ChaincodeStubInterface, record interface{}) (interface{}, error) {
+	if mktrStruct, ok := record.(*MarketerStruct); ok {
+		sealed := *mktrStruct
+		if err := sealMarketer(stub, &sealed); err != nil {
+			return nil, err
+		}
+		return &sealed, nil
+	}
+
+	return record, nil
+}
+
+// presentRecord applies presentMarketer to marketers in a generic record.
+func presentRecord(stub shim.ChaincodeStubInterface, record interface{}) {
+	if mktrStruct, ok := record.(*MarketerStruct); ok {
+		presentMarketer(stub, mktrStruct)
+	}
+}
+
+// presentStoredValue applies presentMarketer to a raw marketer head,
+// version or change log entry read by key, and returns any other value as
+// it is.
+func presentStoredValue(stub shim.ChaincodeStubInterface, key string, value []byte) ([]byte, error) {
+	keyType, ids := splitCompositeKey(key)
+	switch {
+	case keyType == marketerKeyType || keyType == marketerRef("").versionKeyType():
+		return presentMarketerBytes(stub, key, value)
+	case keyType == historyKeyType && len(ids) > 0 && ids[0] == marketerKeyType:
+		var entry historyEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return nil, errorf(codeInternal, "Corrupt history entry: %s", err).withKey(key)
+		}
+		if entry.Record == nil {
+			return value, nil
+		}
+		record, err := presentMarketerBytes(stub, key, entry.Record)
+		if err != nil {
+			return nil, err
+		}
+		entry.Record = record
+		return json.Marshal(entry)
+	}
+
+	return value, nil
+}
+
+// presentMarketerBytes decodes a stored marketer, opens and presents it, and
+// encodes it again.
+func presentMarketerBytes(stub shim.ChaincodeStubInterface, key string, value []byte) ([]byte, error) {
+	var mktrStruct MarketerStruct
+	if err := json.Unmarshal(value, &mktrStruct); err != nil {
+		return nil, errorf(codeInternal, "Corrupt record: %s", err).withKey(key)
+	}
+	if err := openMarketer(stub, &mktrStruct); err != nil {
+		return nil, err
+	}
+	presentMarketer(stub, &mktrStruct)
+
+	return json.Marshal(mktrStruct)
+}
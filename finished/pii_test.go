@@ -0,0 +1,185 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const (
+	// testPIIMarketer sets every PII field.
+	testPIIMarketer = `{"eId":"E2","taxId":"987-65-4321","legalName":"Bo Chen","gender":"F","doB":"1980-02-03","eMail":"bo@example.com","phoneNumber":"212-555-0147","marketerEffectiveDate":"2017-01-01","orgName":"OrgA"}`
+
+	// testLookalike is a legacy marketer whose plaintext TaxId only looks sealed.
+	testLookalike = `{"docType":"marketer","eId":"E5","taxId":"enc:v1:abc","legalName":"Eve Ng"}`
+)
+
+func TestLookalikeSealedValues(t *testing.T) {
+	cc, stub := newTestStub(t)
+	stub.State["MARKETER~E5"] = []byte(testLookalike)
+
+	stub.metadata = nil
+	payload, err := cc.Query(stub, "read", []string{"MARKETER~E5"})
+	if err != nil {
+		t.Fatalf("read of a lookalike sealed TaxId failed: %v", err)
+	}
+	if !strings.Contains(string(payload), `"taxId":"***-**-****"`) {
+		t.Errorf("read of a lookalike sealed TaxId: got %s, want a blank mask", payload)
+	}
+
+	cc, stub = newTestStub(t)
+	stub.State["E5"] = []byte(testLookalike)
+	payload, err = stub.invoke(cc, "migrateKeys")
+	if err != nil {
+		t.Fatalf("migrateKeys failed: %v", err)
+	}
+	if want := `{"migrated":[],"skipped":["E5","hello_world"]}`; string(payload) != want {
+		t.Errorf("migrateKeys of a lookalike sealed TaxId: got %s, want %s", payload, want)
+	}
+	if stub.State["MARKETER~E5"] != nil {
+		t.Error("migrateKeys stored a marketer with a lookalike sealed TaxId")
+	}
+}
+
+// readTestMarketer reads marketer eId and returns the record of the result.
+func readTestMarketer(t *testing.T, cc *SimpleChaincode, stub *testStub, eId string) (MarketerStruct, error) {
+	payload, err := cc.Query(stub, "readMarketer", []string{eId})
+	if err != nil {
+		return MarketerStruct{}, err
+	}
+	var envelope struct {
+		Record MarketerStruct `json:"record"`
+	}
+	if err = json.Unmarshal(payload, &envelope); err != nil {
+		t.Fatalf("readMarketer %s returned %s: %v", eId, payload, err)
+	}
+
+	return envelope.Record, nil
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	sealed, err := sealValue(testPIIKey, "E1", "taxId", "123-45-6789")
+	if err != nil {
+		t.Fatalf("sealValue failed: %v", err)
+	}
+	if !isSealed(sealed) || sealedMask("taxId", sealed) != "***-**-6789" || strings.Contains(sealed, "45-6789:") {
+		t.Errorf("sealValue returned %q", sealed)
+	}
+	if again, _ := sealValue(testPIIKey, "E1", "taxId", "123-45-6789"); again != sealed {
+		t.Errorf("sealing twice gave %q and %q; want the same value on every peer", sealed, again)
+	}
+	if other, _ := sealValue(testPIIKey, "E2", "taxId", "123-45-6789"); other == sealed {
+		t.Error("the same TaxId of two marketers sealed identically")
+	}
+
+	if plain, err := openValue(testPIIKey, "E1", "taxId", sealed); err != nil || plain != "123-45-6789" {
+		t.Errorf("openValue: got %q, %v; want the TaxId", plain, err)
+	}
+	otherKey := bytes.Repeat([]byte{8}, piiKeySize)
+	if plain, err := openValue(otherKey, "E1", "taxId", sealed); errorCode(err) != codeInternal {
+		t.Errorf("openValue with another key: got %q, %v; want an %s error", plain, err, codeInternal)
+	}
+	if plain, err := openValue(testPIIKey, "E2", "taxId", sealed); errorCode(err) != codeInternal {
+		t.Errorf("openValue for another marketer: got %q, %v; want an %s error", plain, err, codeInternal)
+	}
+}
+
+func TestPIIKeyChecks(t *testing.T) {
+	cc, stub := newTestStub(t)
+	stub.mustInvoke(t, cc, "write", testPIIMarketer)
+
+	stored := string(stub.State["MARKETER~E2"])
+	for _, plain := range []string{"987-65-4321", "1980-02-03", "bo@example.com", "212-555-0147"} {
+		if strings.Contains(stored, plain) {
+			t.Errorf("stored marketer holds %q in plaintext: %s", plain, stored)
+		}
+	}
+
+	metadata := stub.metadata
+	stub.metadata = []byte(`{"piiKey":"` + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, piiKeySize)) + `"}`)
+	if _, err := readTestMarketer(t, cc, stub, "E2"); errorCode(err) != codeForbidden {
+		t.Errorf("readMarketer with the wrong key: got %v, want a %s error", err, codeForbidden)
+	}
+	if _, err := stub.invoke(cc, "write", testMarketer); errorCode(err) != codeForbidden {
+		t.Errorf("write with the wrong key: got %v, want a %s error", err, codeForbidden)
+	}
+	stub.metadata = []byte(`{"piiKey":"c2hvcnQ="}`)
+	if _, err := readTestMarketer(t, cc, stub, "E2"); errorCode(err) != codeBadRequest {
+		t.Errorf("readMarketer with a short key: got %v, want a %s error", err, codeBadRequest)
+	}
+	stub.metadata = nil
+	if _, err := stub.invoke(cc, "write", testMarketer); errorCode(err) != codeForbidden {
+		t.Errorf("write without the key: got %v, want a %s error", err, codeForbidden)
+	}
+	stub.metadata = metadata
+
+	sum := sha256.Sum256(testPIIKey)
+	if _, err := stub.invoke(cc, "init", "hello", hex.EncodeToString(sum[:])); err != nil {
+		t.Errorf("init with the same fingerprint: %v", err)
+	}
+	sum = sha256.Sum256(bytes.Repeat([]byte{8}, piiKeySize))
+	if _, err := stub.invoke(cc, "init", "hello", hex.EncodeToString(sum[:])); errorCode(err) != codeConflict {
+		t.Errorf("init with another fingerprint: got %v, want a %s error", err, codeConflict)
+	}
+}
+
+func TestPIIMasksByRole(t *testing.T) {
+	plain := MarketerStruct{TaxId: "987-65-4321", Gender: "F", DoB: "1980-02-03", EMail: "bo@example.com", PhoneNumber: "212-555-0147"}
+	masked := MarketerStruct{TaxId: "***-**-4321", Gender: "*", DoB: "****-**-**", EMail: "b***@example.com", PhoneNumber: "***-***-0147"}
+
+	cases := []struct {
+		role, org string
+		withKey   bool
+		want      MarketerStruct
+		wantHash  bool
+	}{
+		{roleAdmin, "", true, plain, true},
+		{roleAdmin, "", false, masked, true},
+		{roleWriter, "OrgA", true, plain, true},
+		{roleWriter, "OrgA", false, masked, true},
+		{roleWriter, "OrgB", true, masked, false},
+		{roleAuditor, "OrgA", true, masked, false},
+	}
+
+	cc, stub := newTestStub(t)
+	stub.mustInvoke(t, cc, "write", testPIIMarketer)
+	metadata := stub.metadata
+	for _, c := range cases {
+		stub.attrs = map[string]string{roleAttribute: c.role, orgAttribute: c.org}
+		stub.metadata = nil
+		if c.withKey {
+			stub.metadata = metadata
+		}
+
+		got, err := readTestMarketer(t, cc, stub, "E2")
+		if err != nil {
+			t.Errorf("%s of %q, key %t: readMarketer failed: %v", c.role, c.org, c.withKey, err)
+			continue
+		}
+		for i, field := range piiFields(&got) {
+			if want := *piiFields(&c.want)[i].value; *field.value != want {
+				t.Errorf("%s of %q, key %t: %s is %q, want %q", c.role, c.org, c.withKey, field.name, *field.value, want)
+			}
+		}
+		if (got.TaxIdHash != "") != c.wantHash {
+			t.Errorf("%s of %q, key %t: taxIdHash is %q", c.role, c.org, c.withKey, got.TaxIdHash)
+		}
+	}
+}
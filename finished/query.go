@@ -0,0 +1,153 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// schemaVersion is the version of the entity documents returned in a recordEnvelope.
+const schemaVersion = 1
+
+// recordEnvelope wraps every record returned by the typed read queries.
+type recordEnvelope struct {
+	Type          string      `json:"type"`
+	Key           string      `json:"key"`
+	SchemaVersion int         `json:"schemaVersion"`
+	AsOf          string      `json:"asOf,omitempty"`
+	Record        interface{} `json:"record"`
+}
+
+// getEntity loads the document stored under key into v after checking that
+// it is a docType document.
+func getEntity(stub shim.ChaincodeStubInterface, docType, key string, v interface{}) error {
+	valueBytes, err := stub.GetState(key)
+	if err != nil {
+		return newError(codeInternal, "Failed to get state").withKey(key)
+	}
+	if valueBytes == nil {
+		return errorf(codeNotFound, "No %s found", docType).withKey(key)
+	}
+
+	var header struct {
+		ObjectType string `json:"docType"`
+	}
+	if err = json.Unmarshal(valueBytes, &header); err != nil {
+		return newError(codeInternal, "Corrupt record").withKey(key)
+	}
+	if header.ObjectType != docType {
+		return errorf(codeNotFound, "Key holds a %q record, not a %s", header.ObjectType, docType).withKey(key)
+	}
+
+	if err = json.Unmarshal(valueBytes, v); err != nil {
+		return newError(codeInternal, "Corrupt record").withKey(key)
+	}
+
+	return openRecord(stub, v)
+}
+
+// checkStoredValue verifies that value, read from key, decodes: into the
+// entity struct for entity keys and as JSON for any other value that looks
+// like JSON. Other values, such as hello_world, are returned as they are.
+func checkStoredValue(key string, value []byte) error {
+	keyType, _ := splitCompositeKey(key)
+	for docType, entityKeyType := range entityKeyTypes {
+		if keyType != entityKeyType {
+			continue
+		}
+		record := entityRef{docType: docType}.newRecord()
+		if err := json.Unmarshal(value, record); err != nil {
+			return errorf(codeInternal, "Corrupt record: %s", err).withKey(key)
+		}
+		return nil
+	}
+
+	trimmed := bytes.TrimSpace(value)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		var v interface{}
+		if err := json.Unmarshal(trimmed, &v); err != nil {
+			return errorf(codeInternal, "Corrupt record: %s", err).withKey(key)
+		}
+	}
+
+	return nil
+}
+
+// readEntity loads a docType record and returns it wrapped in a recordEnvelope.
+func readEntity(stub shim.ChaincodeStubInterface, docType, key string, v interface{}) ([]byte, error) {
+	if err := getEntity(stub, docType, key, v); err != nil {
+		return nil, err
+	}
+	presentRecord(stub, v)
+
+	return json.Marshal(recordEnvelope{
+		Type:          docType,
+		Key:           key,
+		SchemaVersion: schemaVersion,
+		Record:        v,
+	})
+}
+
+// readMarketer - query function to read a marketer by eId
+func (t *SimpleChaincode) readMarketer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if err := checkArgCount(args, 1); err != nil {
+		return nil, err
+	}
+
+	key, err := marketerKey(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var mktrStruct MarketerStruct
+	return readEntity(stub, marketerDocType, key, &mktrStruct)
+}
+
+// readAccount - query function to read an account by policyPrefix and accountNumber
+func (t *SimpleChaincode) readAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if err := checkArgCount(args, 2); err != nil {
+		return nil, err
+	}
+
+	key, err := accountKey(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var accStruct AccountStruct
+	return readEntity(stub, accountDocType, key, &accStruct)
+}
+
+// readAssignment - query function to read an assignment by assignmentId.
+// With "expanded" as the second argument the record also carries the
+// current marketer, owner and account records the assignment points at.
+func (t *SimpleChaincode) readAssignment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) == 2 && args[1] == "expanded" {
+		return t.readAssignmentExpanded(stub, args[0])
+	}
+	if err := checkArgCount(args, 1); err != nil {
+		return nil, err
+	}
+
+	key, err := assignmentKey(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var assignStruct AssignmentStruct
+	return readEntity(stub, assignmentDocType, key, &assignStruct)
+}
@@ -0,0 +1,245 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Split percentages are fixed-point decimals with up to splitDecimals
+// places, held as integer units of 1/splitScale of a percent.
+const (
+	splitDecimals = 4
+	splitScale    = 10000
+	splitFull     = 100 * splitScale
+)
+
+// parseSplit parses a percentage such as "100", "33.3333" or "12.5".
+func parseSplit(value string) (int64, error) {
+	whole, frac := value, ""
+	if i := strings.Index(value, "."); i >= 0 {
+		whole, frac = value[:i], value[i+1:]
+	}
+	if whole == "" || len(frac) > splitDecimals || (strings.Contains(value, ".") && frac == "") {
+		return 0, errorf(codeValidation, "splitPercentage must be a decimal with at most %d places, got %q", splitDecimals, value).withField("splitPercentage")
+	}
+
+	digits := whole + frac + strings.Repeat("0", splitDecimals-len(frac))
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, errorf(codeValidation, "splitPercentage must be a decimal with at most %d places, got %q", splitDecimals, value).withField("splitPercentage")
+		}
+	}
+
+	units, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || units > splitFull {
+		return 0, errorf(codeValidation, "splitPercentage must be between 0 and 100, got %q", value).withField("splitPercentage")
+	}
+
+	return units, nil
+}
+
+// formatSplit is the inverse of parseSplit, without trailing zeros.
+func formatSplit(units int64) string {
+	s := fmt.Sprintf("%d.%0*d", units/splitScale, splitDecimals, units%splitScale)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// splitStartDate is the date an assignment's split starts to count.
+func splitStartDate(assignStruct AssignmentStruct) string {
+	if assignStruct.SplitEffectiveDate != "" {
+		return assignStruct.SplitEffectiveDate
+	}
+
+	return assignStruct.AssignmentEffectiveDate
+}
+
+// splitInForceOn reports whether an assignment's split counts towards its
+// account's total on date.
+func splitInForceOn(assignStruct AssignmentStruct, date string) bool {
+	return assignmentActiveOn(assignStruct, date) && onOrBefore(splitStartDate(assignStruct), date)
+}
+
+// checkSplits canonicalises the assignment's splitPercentage and verifies
+// that the active splits of the same role type on its account never add up
+// to more than 100% while the assignment is in force. Totals are checked on
+// the assignment's own start date and on every later date another
+// assignment's split starts.
+func checkSplits(stub shim.ChaincodeStubInterface, assignStruct *AssignmentStruct) error {
+	units, err := parseSplit(assignStruct.SplitPercentage)
+	if err != nil {
+		return err
+	}
+	assignStruct.SplitPercentage = formatSplit(units)
+	if !strings.EqualFold(assignStruct.AssignmentStatus, assignmentActive) {
+		return nil
+	}
+
+	assignments, err := accountAssignments(stub, assignStruct.PolicyPrefix, assignStruct.AccountNumber)
+	if err != nil {
+		return err
+	}
+
+	var peers []AssignmentStruct
+	start := splitStartDate(*assignStruct)
+	dates := []string{start}
+	for _, other := range assignments {
+		if other.AssignmentId == assignStruct.AssignmentId || other.AssignmentRoleType != assignStruct.AssignmentRoleType {
+			continue
+		}
+		peers = append(peers, other)
+		if otherStart := splitStartDate(other); otherStart > start && splitInForceOn(*assignStruct, otherStart) {
+			dates = append(dates, otherStart)
+		}
+	}
+
+	for _, date := range dates {
+		total := units
+		for _, other := range peers {
+			if !splitInForceOn(other, date) {
+				continue
+			}
+			otherUnits, err := parseSplit(other.SplitPercentage)
+			if err != nil {
+				key, _ := assignmentKey(other.AssignmentId)
+				return errorf(codeInternal, "Corrupt split: %s", err).withKey(key)
+			}
+			total += otherUnits
+		}
+		if total > splitFull {
+			return errorf(codeValidation, "Splits for role %q on account %s %s would total %s%% on %s",
+				assignStruct.AssignmentRoleType, assignStruct.PolicyPrefix, assignStruct.AccountNumber, formatSplit(total), date).withField("splitPercentage")
+		}
+	}
+
+	return nil
+}
+
+// txDate returns the transaction's timestamp as a YYYY-MM-DD date.
+func txDate(stub shim.ChaincodeStubInterface) (string, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil || ts == nil {
+		return "", newError(codeInternal, "Transaction timestamp unavailable; pass an explicit date")
+	}
+
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(dateLayout), nil
+}
+
+type splitEntry struct {
+	AssignmentId    string `json:"assignmentId"`
+	EId             string `json:"eId"`
+	OwnerEId        string `json:"ownerEId"`
+	SplitPercentage string `json:"splitPercentage"`
+}
+
+type splitRole struct {
+	AssignmentRoleType string       `json:"assignmentRoleType"`
+	Total              string       `json:"total"`
+	Complete           bool         `json:"complete"`
+	Splits             []splitEntry `json:"splits"`
+}
+
+type splitTable struct {
+	PolicyPrefix  string      `json:"policyPrefix"`
+	AccountNumber string      `json:"accountNumber"`
+	AsOf          string      `json:"asOf"`
+	Roles         []splitRole `json:"roles"`
+}
+
+// buildSplitTable groups the splits in force on date by role type. A role is
+// complete when its splits add up to exactly 100%.
+func buildSplitTable(policyPrefix, accountNumber, date string, assignments []AssignmentStruct) (splitTable, error) {
+	table := splitTable{PolicyPrefix: policyPrefix, AccountNumber: accountNumber, AsOf: date, Roles: []splitRole{}}
+
+	byRole := map[string]*splitRole{}
+	totals := map[string]int64{}
+	var roles []string
+	for _, assignStruct := range assignments {
+		if !splitInForceOn(assignStruct, date) {
+			continue
+		}
+		units, err := parseSplit(assignStruct.SplitPercentage)
+		if err != nil {
+			key, _ := assignmentKey(assignStruct.AssignmentId)
+			return table, errorf(codeInternal, "Corrupt split: %s", err).withKey(key)
+		}
+
+		role, ok := byRole[assignStruct.AssignmentRoleType]
+		if !ok {
+			role = &splitRole{AssignmentRoleType: assignStruct.AssignmentRoleType}
+			byRole[assignStruct.AssignmentRoleType] = role
+			roles = append(roles, assignStruct.AssignmentRoleType)
+		}
+		role.Splits = append(role.Splits, splitEntry{
+			AssignmentId:    assignStruct.AssignmentId,
+			EId:             assignStruct.EId,
+			OwnerEId:        assignStruct.OwnerEId,
+			SplitPercentage: formatSplit(units),
+		})
+		totals[assignStruct.AssignmentRoleType] += units
+	}
+
+	sort.Strings(roles)
+	for _, name := range roles {
+		role := byRole[name]
+		role.Total = formatSplit(totals[name])
+		role.Complete = totals[name] == splitFull
+		table.Roles = append(table.Roles, *role)
+	}
+
+	return table, nil
+}
+
+// splitTable - query function returning the splits in force on an account.
+// args are the policyPrefix, the accountNumber and an optional YYYY-MM-DD
+// date, which defaults to the transaction date.
+func (t *SimpleChaincode) splitTable(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	var date string
+	var err error
+	if len(args) == 3 {
+		date = args[2]
+		_, err = parseDate("date", date)
+	} else {
+		date, err = txDate(stub)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err = getAccount(stub, args[0], args[1]); err != nil {
+		return nil, err
+	}
+	assignments, err := accountAssignments(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := buildSplitTable(args[0], args[1], date, assignments)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(table)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseSplit(t *testing.T) {
+	valid := map[string]int64{
+		"100":     1000000,
+		"33.3333": 333333,
+		"12.5":    125000,
+		"0":       0,
+		"007.50":  75000,
+	}
+	for value, want := range valid {
+		if units, err := parseSplit(value); err != nil || units != want {
+			t.Errorf("parseSplit(%q): got %d, %v; want %d", value, units, err, want)
+		}
+	}
+	if got := formatSplit(125000); got != "12.5" {
+		t.Errorf("formatSplit(125000): got %q, want 12.5", got)
+	}
+	if got := formatSplit(1000000); got != "100" {
+		t.Errorf("formatSplit(1000000): got %q, want 100", got)
+	}
+
+	for _, value := range []string{"", "100.0001", "101", "12.34567", "1.", ".5", "-1", "1e2", "abc", "99999999999999999999"} {
+		if units, err := parseSplit(value); errorCode(err) != codeValidation {
+			t.Errorf("parseSplit(%q): got %d, %v; want a %s error", value, units, err, codeValidation)
+		}
+	}
+}
+
+// assignSplit is the test assignment with its own id, role, split and
+// effective date.
+func assignSplit(id, role, split, date string) string {
+	return fmt.Sprintf(`{"assignmentId":%q,"eId":"E1","ownerEId":"E1","policyPrefix":"P","accountNumber":"A1","assignmentRoleType":%q,"splitPercentage":%q,"assignmentEffectiveDate":%q}`, id, role, split, date)
+}
+
+// querySplitTable returns the split table of the test account on date.
+func querySplitTable(t *testing.T, cc *SimpleChaincode, stub *testStub, date string) splitTable {
+	payload, err := cc.Query(stub, "splitTable", []string{"P", "A1", date})
+	if err != nil {
+		t.Fatalf("splitTable on %s failed: %v", date, err)
+	}
+	var table splitTable
+	if err = json.Unmarshal(payload, &table); err != nil {
+		t.Fatalf("splitTable on %s returned %s: %v", date, payload, err)
+	}
+
+	return table
+}
+
+func TestSplitsCapAt100(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 2)
+
+	stub.mustInvoke(t, cc, "assign", assignSplit("S1", "Primary", "60.00", "2017-06-01"))
+	if payload, err := stub.invoke(cc, "assign", assignSplit("S2", "Primary", "40.0001", "2017-06-01")); errorCode(err) != codeValidation {
+		t.Errorf("assign taking Primary to 100.0001%%: got %q, %v; want a %s error", payload, err, codeValidation)
+	}
+	if payload, err := stub.invoke(cc, "assign", assignSplit("S2", "Primary", "45", "2018-01-01")); errorCode(err) != codeValidation {
+		t.Errorf("assign taking Primary to 105%% from a later date: got %q, %v; want a %s error", payload, err, codeValidation)
+	}
+	stub.mustInvoke(t, cc, "assign", assignSplit("S3", "Secondary", "100", "2017-06-01"))
+	stub.mustInvoke(t, cc, "assign", assignSplit("S2", "Primary", "25", "2018-01-01"))
+
+	table := querySplitTable(t, cc, stub, "2017-12-31")
+	want := []splitRole{
+		{AssignmentRoleType: "Primary", Total: "60", Splits: []splitEntry{{"S1", "E1", "E1", "60"}}},
+		{AssignmentRoleType: "Secondary", Total: "100", Complete: true, Splits: []splitEntry{{"S3", "E1", "E1", "100"}}},
+	}
+	if !reflect.DeepEqual(table.Roles, want) {
+		t.Errorf("splitTable on 2017-12-31: got %+v, want %+v", table.Roles, want)
+	}
+
+	table = querySplitTable(t, cc, stub, "2018-01-01")
+	if primary := table.Roles[0]; primary.Total != "85" || primary.Complete || len(primary.Splits) != 2 {
+		t.Errorf("splitTable on 2018-01-01: got Primary %+v, want S1 and S2 totalling 85", primary)
+	}
+
+	if table = querySplitTable(t, cc, stub, "2017-05-31"); len(table.Roles) != 0 {
+		t.Errorf("splitTable before any assignment: got %+v", table.Roles)
+	}
+	if payload, err := stub.invoke(cc, "updateAssignment", `{"assignmentId":"S1","splitPercentage":"75.5"}`); errorCode(err) != codeValidation {
+		t.Errorf("updateAssignment taking Primary to 100.5%%: got %q, %v; want a %s error", payload, err, codeValidation)
+	}
+	stub.mustInvoke(t, cc, "updateAssignment", `{"assignmentId":"S1","splitPercentage":"75"}`)
+	if primary := querySplitTable(t, cc, stub, "2018-01-01").Roles[0]; primary.Total != "100" || !primary.Complete {
+		t.Errorf("splitTable after the update: got Primary %+v, want a complete 100", primary)
+	}
+}
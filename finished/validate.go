@@ -0,0 +1,243 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// fieldCheck returns why value is invalid, or "" when it is valid. Empty
+// values are only checked by required.
+type fieldCheck func(value string) string
+
+// recordSchema declares the rules a record must satisfy before it is stored.
+// Fields are named by their json names.
+type recordSchema struct {
+	required []string
+	fields   map[string][]fieldCheck
+	// dateOrder lists {earlier, later} date field pairs; when both are set
+	// the later one may not come before the earlier one.
+	dateOrder [][2]string
+}
+
+// Allowed values of the enumerated fields. Only the statuses the chaincode
+// itself sets are enumerated, and matched ignoring case as everywhere else.
+// MarketerType, MarketerRole, Gender, AccountStatus, ValidationStatus and
+// DisclosureStatus stay free text until their values are defined: records
+// already on the ledger must keep passing validation when they are updated.
+var (
+	marketerStatuses   = []string{marketerActive, marketerSuspended, marketerTerminated}
+	assignmentStatuses = []string{assignmentActive, assignmentTerminated}
+
+	// usStateCodes are the USPS codes of the states, DC and the territories.
+	usStateCodes = []string{
+		"AL", "AK", "AZ", "AR", "CA", "CO", "CT", "DE", "DC", "FL", "GA", "HI", "ID", "IL",
+		"IN", "IA", "KS", "KY", "LA", "ME", "MD", "MA", "MI", "MN", "MS", "MO", "MT", "NE",
+		"NV", "NH", "NJ", "NM", "NY", "NC", "ND", "OH", "OK", "OR", "PA", "RI", "SC", "SD",
+		"TN", "TX", "UT", "VT", "VA", "WA", "WV", "WI", "WY", "AS", "GU", "MP", "PR", "VI",
+	}
+)
+
+var (
+	emailPattern   = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	usPhonePattern = regexp.MustCompile(`^(\+?1[ .-]?)?(\([2-9][0-9]{2}\)|[2-9][0-9]{2})[ .-]?[0-9]{3}[ .-]?[0-9]{4}$`)
+	zipPattern     = regexp.MustCompile(`^[0-9]{5}(-[0-9]{4})?$`)
+)
+
+func isDate(value string) string {
+	if _, err := time.Parse(dateLayout, value); err != nil {
+		return "must be a YYYY-MM-DD date"
+	}
+	return ""
+}
+
+func isEmail(value string) string {
+	if !emailPattern.MatchString(value) {
+		return "must be an email address"
+	}
+	return ""
+}
+
+func isUSPhone(value string) string {
+	if !usPhonePattern.MatchString(value) {
+		return "must be a 10-digit US phone number"
+	}
+	return ""
+}
+
+func isZIP(value string) string {
+	if !zipPattern.MatchString(value) {
+		return "must be a ZIP or ZIP+4 code"
+	}
+	return ""
+}
+
+func isStateCode(value string) string {
+	for _, code := range usStateCodes {
+		if value == code {
+			return ""
+		}
+	}
+	return "must be a two-letter US state code"
+}
+
+func oneOf(allowed ...string) fieldCheck {
+	return func(value string) string {
+		for _, a := range allowed {
+			if strings.EqualFold(value, a) {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(allowed, ", ")
+	}
+}
+
+var (
+	marketerSchema = recordSchema{
+		required: marketerRequired,
+		fields: map[string][]fieldCheck{
+			"beginDate":             {isDate},
+			"doB":                   {isDate},
+			"marketerEffectiveDate": {isDate},
+			"marketerEndDate":       {isDate},
+			"marketerStatus":        {oneOf(marketerStatuses...)},
+			"state":                 {isStateCode},
+			"postalCode":            {isZIP},
+			"phoneNumber":           {isUSPhone},
+			"eMail":                 {isEmail},
+		},
+		dateOrder: [][2]string{
+			{"doB", "beginDate"},
+			{"beginDate", "marketerEndDate"},
+			{"marketerEffectiveDate", "marketerEndDate"},
+		},
+	}
+
+	accountSchema = recordSchema{
+		required: accountRequired,
+		fields: map[string][]fieldCheck{
+			"accountEffectiveDate":       {isDate},
+			"accountStatusEffectiveDate": {isDate},
+			"disclosureEffectiveDate":    {isDate},
+		},
+		dateOrder: [][2]string{
+			{"accountEffectiveDate", "accountStatusEffectiveDate"},
+		},
+	}
+
+	assignmentSchema = recordSchema{
+		required: assignmentRequired,
+		fields: map[string][]fieldCheck{
+			"assignmentEffectiveDate": {isDate},
+			"assignmentEndDate":       {isDate},
+			"splitEffectiveDate":      {isDate},
+			"assignmentStatus":        {oneOf(assignmentStatuses...)},
+		},
+		dateOrder: [][2]string{
+			{"assignmentEffectiveDate", "assignmentEndDate"},
+			{"splitEffectiveDate", "assignmentEndDate"},
+		},
+	}
+)
+
+// violation is one rule a record breaks. Value is left out for PII fields,
+// which must not reach error responses or peer logs.
+type violation struct {
+	Field   string `json:"field"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+// validate checks the struct v points to against schema and reports every
+// violation at once, as the details of a VALIDATION error.
+func validate(v interface{}, schema recordSchema) error {
+	fields := jsonFields(v)
+	val := reflect.Indirect(reflect.ValueOf(v))
+	value := func(name string) string {
+		idx, ok := fields[name]
+		if !ok {
+			return ""
+		}
+		return val.Field(idx).String()
+	}
+
+	var violations []violation
+	for _, name := range schema.required {
+		if strings.TrimSpace(value(name)) == "" {
+			violations = append(violations, violation{Field: name, Message: "is required"})
+		}
+	}
+
+	// Report fields in declaration order so the error is deterministic.
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		fieldValue := value(name)
+		// Input is never sealed (see rejectSealed), so a sealed value was
+		// loaded from state and was checked before it was sealed.
+		if fieldValue == "" || isSealed(fieldValue) {
+			continue
+		}
+		for _, check := range schema.fields[name] {
+			if msg := check(fieldValue); msg != "" {
+				violations = append(violations, violation{name, echoValue(name, fieldValue), msg})
+				break
+			}
+		}
+	}
+
+	for _, pair := range schema.dateOrder {
+		from, to := value(pair[0]), value(pair[1])
+		if from == "" || to == "" || isDate(from) != "" || isDate(to) != "" {
+			continue
+		}
+		if to < from {
+			msg := "may not be before " + pair[0]
+			if !isPIIField(pair[0]) {
+				msg += " " + from
+			}
+			violations = append(violations, violation{pair[1], echoValue(pair[1], to), msg})
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return violationsError(violations)
+}
+
+// echoValue returns the value to report in a violation of field.
+func echoValue(field, value string) string {
+	if isPIIField(field) {
+		return ""
+	}
+	return value
+}
+
+// violationsError reports violations as a VALIDATION error.
+func violationsError(violations []violation) error {
+	return newError(codeValidation, "Validation failed").withDetails(violations)
+}
+
+// fieldsError reports the same violation for each of fields.
+func fieldsError(fields []string, message string) error {
+	violations := make([]violation, len(fields))
+	for i, field := range fields {
+		violations[i] = violation{Field: field, Message: message}
+	}
+	return violationsError(violations)
+}
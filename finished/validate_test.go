@@ -0,0 +1,79 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// violations returns the violations reported by a VALIDATION error.
+func violations(t *testing.T, err error) []violation {
+	if errorCode(err) != codeValidation {
+		t.Fatalf("got %v, want a %s error", err, codeValidation)
+	}
+	var payload struct {
+		Details []violation `json:"details"`
+	}
+	if jsonErr := json.Unmarshal([]byte(err.Error()), &payload); jsonErr != nil {
+		t.Fatalf("cannot decode %v: %v", err, jsonErr)
+	}
+
+	return payload.Details
+}
+
+func TestViolationsLeaveOutPII(t *testing.T) {
+	cc, stub := newTestStub(t)
+
+	_, err := stub.invoke(cc, "write", `{"eId":"E1","taxId":"123-45-6789","legalName":"Ann Lee","doB":"1999-13-01","beginDate":"1990-01-01","eMail":"ann.example.com","phoneNumber":"555","postalCode":"x1"}`)
+	want := []violation{
+		{Field: "doB", Message: "must be a YYYY-MM-DD date"},
+		{Field: "postalCode", Value: "x1", Message: "must be a ZIP or ZIP+4 code"},
+		{Field: "phoneNumber", Message: "must be a 10-digit US phone number"},
+		{Field: "eMail", Message: "must be an email address"},
+	}
+	if got := violations(t, err); !reflect.DeepEqual(got, want) {
+		t.Errorf("write: got %+v, want %+v", got, want)
+	}
+	for _, plain := range []string{"1999-13-01", "ann.example.com", "555"} {
+		if strings.Contains(err.Error(), plain) {
+			t.Errorf("write error echoes %q: %v", plain, err)
+		}
+	}
+
+	_, err = stub.invoke(cc, "write", `{"eId":"E1","taxId":"123-45-6789","legalName":"Ann Lee","doB":"1990-06-01","beginDate":"1980-01-01"}`)
+	want = []violation{{Field: "beginDate", Value: "1980-01-01", Message: "may not be before doB"}}
+	if got := violations(t, err); !reflect.DeepEqual(got, want) {
+		t.Errorf("write with beginDate before doB: got %+v, want %+v", got, want)
+	}
+}
+
+func TestFreeTextFields(t *testing.T) {
+	cc, stub := newTestStub(t)
+
+	stub.mustInvoke(t, cc, "write", `{"eId":"E1","taxId":"123-45-6789","legalName":"Ann Lee","gender":"female","marketerType":"Captive","marketerRole":"Producer"}`)
+	stub.mustInvoke(t, cc, "account", `{"policyPrefix":"P","accountNumber":"A1","accountStatus":"Lapsed","validationStatus":"Checked","disclosureStatus":"Sent"}`)
+
+	// Stored statuses are matched ignoring case, as the lifecycle does.
+	stub.State["MARKETER~E3"] = []byte(`{"docType":"marketer","eId":"E3","taxId":"111-22-3333","legalName":"Cy Diaz","marketerStatus":"active"}`)
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E3","legalName":"Cy Dias"}`)
+
+	_, err := stub.invoke(cc, "write", `{"eId":"E4","taxId":"444-55-6666","legalName":"Di Fox","marketerStatus":"Retired"}`)
+	want := []violation{{Field: "marketerStatus", Value: "Retired", Message: "must be one of Active, Suspended, Terminated"}}
+	if got := violations(t, err); !reflect.DeepEqual(got, want) {
+		t.Errorf("write with an unknown status: got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,547 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Every change to an entity is kept as a full snapshot under
+//
+//	<TYPE>_VERSION~<ids...>~<effectiveDate>~<recordedAt>
+//
+// so the versions of one entity sort by business date and, within a date, by
+// the time they were recorded. The record under the entity's own key (the
+// head) is the version in effect on the date of the last transaction that
+// touched it. Versions dated in the future also get a PENDING~<date>~... key
+// so that rollForward can promote them to the head once their date arrives.
+const (
+	versionKeySuffix = "_VERSION"
+	pendingKeyType   = "PENDING"
+
+	// baselineDate dates the first version of records written before
+	// versioning existed when they carry no effective date of their own.
+	baselineDate = "0001-01-01"
+)
+
+// entityRef identifies a stored entity independently of its type.
+type entityRef struct {
+	docType string
+	ids     []string
+}
+
+var entityKeyTypes = map[string]string{
+	marketerDocType:   marketerKeyType,
+	accountDocType:    accountKeyType,
+	assignmentDocType: assignmentKeyType,
+}
+
+func marketerRef(eId string) entityRef {
+	return entityRef{marketerDocType, []string{eId}}
+}
+
+func accountRef(policyPrefix, accountNumber string) entityRef {
+	return entityRef{accountDocType, []string{policyPrefix, accountNumber}}
+}
+
+func assignmentRef(assignmentId string) entityRef {
+	return entityRef{assignmentDocType, []string{assignmentId}}
+}
+
+// key returns the key of the entity's head record.
+func (ref entityRef) key() (string, error) {
+	keyType, ok := entityKeyTypes[ref.docType]
+	if !ok {
+		return "", errorf(codeBadRequest, "Unknown entity type %q", ref.docType).withField("type")
+	}
+
+	return compositeKey(keyType, ref.ids...)
+}
+
+func (ref entityRef) versionKeyType() string {
+	return entityKeyTypes[ref.docType] + versionKeySuffix
+}
+
+// newRecord returns a pointer to an empty record of the entity's type.
+func (ref entityRef) newRecord() interface{} {
+	switch ref.docType {
+	case marketerDocType:
+		return new(MarketerStruct)
+	case accountDocType:
+		return new(AccountStruct)
+	default:
+		return new(AssignmentStruct)
+	}
+}
+
+// storeHead writes record, a pointer returned by newRecord, as the entity's head.
+func (ref entityRef) storeHead(stub shim.ChaincodeStubInterface, record interface{}) error {
+	key, err := ref.key()
+	if err != nil {
+		return err
+	}
+
+	switch r := record.(type) {
+	case *MarketerStruct:
+		return storeMarketer(stub, key, *r)
+	case *AccountStruct:
+		return storeAccount(stub, key, *r)
+	case *AssignmentStruct:
+		return storeAssignment(stub, key, *r)
+	}
+
+	return errorf(codeInternal, "Cannot store %T as %s", record, ref.docType)
+}
+
+// recordedAt orders versions recorded on the same business date. It comes
+// from the transaction timestamp so every peer computes the same key.
+func recordedAt(stub shim.ChaincodeStubInterface) (string, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil || ts == nil {
+		return "", newError(codeInternal, "Transaction timestamp unavailable")
+	}
+
+	return fmt.Sprintf("%010d%09d", ts.Seconds, ts.Nanos), nil
+}
+
+// recordVersion stores record as the version of ref in effect from
+// effectiveDate. It does not touch the head.
+func recordVersion(stub shim.ChaincodeStubInterface, ref entityRef, effectiveDate string, record interface{}) error {
+	if _, err := parseDate("effectiveDate", effectiveDate); err != nil {
+		return err
+	}
+	stamp, err := recordedAt(stub)
+	if err != nil {
+		return err
+	}
+
+	versionKey, err := compositeKey(ref.versionKeyType(), append(append([]string{}, ref.ids...), effectiveDate, stamp)...)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealRecord(stub, record)
+	if err != nil {
+		return err
+	}
+	recordBytes, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	if err = stub.PutState(versionKey, recordBytes); err != nil {
+		return err
+	}
+
+	today, err := txDate(stub)
+	if err != nil {
+		return err
+	}
+	if effectiveDate > today {
+		pendingKey, err := compositeKey(pendingKeyType, append([]string{effectiveDate, ref.docType}, ref.ids...)...)
+		if err != nil {
+			return err
+		}
+		if err = stub.PutState(pendingKey, indexValue); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// versionAsOf loads into record the version of ref in effect on date. An
+// entity without any versions was written before versioning existed; its
+// head stands in for every date.
+func versionAsOf(stub shim.ChaincodeStubInterface, ref entityRef, date string, record interface{}) (bool, error) {
+	startKey, endKey, err := prefixRange(ref.versionKeyType(), ref.ids...)
+	if err != nil {
+		return false, err
+	}
+
+	iter, err := stub.RangeQueryState(startKey, startKey+date+keySeparator+maxKeySuffix)
+	if err != nil {
+		return false, err
+	}
+	var value []byte
+	for iter.HasNext() {
+		_, v, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return false, err
+		}
+		value = v
+	}
+	iter.Close()
+
+	if value == nil {
+		anyKeys, err := scanKeys(stub, startKey, endKey)
+		if err != nil {
+			return false, err
+		}
+		if len(anyKeys) > 0 {
+			return false, nil
+		}
+
+		key, err := ref.key()
+		if err != nil {
+			return false, err
+		}
+		if value, err = stub.GetState(key); err != nil || value == nil {
+			return false, err
+		}
+	}
+
+	if err = json.Unmarshal(value, record); err != nil {
+		return false, errorf(codeInternal, "Corrupt %s version for %v: %s", ref.docType, ref.ids, err)
+	}
+
+	return true, openRecord(stub, record)
+}
+
+// refreshHead makes the version in effect on the transaction date the head
+// and reports whether it did. An entity without a head has been deleted and
+// is left alone, so that a late version cannot bring it back.
+func refreshHead(stub shim.ChaincodeStubInterface, ref entityRef) (bool, error) {
+	today, err := txDate(stub)
+	if err != nil {
+		return false, err
+	}
+
+	key, err := ref.key()
+	if err != nil {
+		return false, err
+	}
+	headBytes, err := stub.GetState(key)
+	if err != nil || headBytes == nil {
+		return false, err
+	}
+
+	record := ref.newRecord()
+	found, err := versionAsOf(stub, ref, today, record)
+	if err != nil || !found {
+		return false, err
+	}
+
+	return true, ref.storeHead(stub, record)
+}
+
+// dropPending removes what a deleted entity still has waiting for
+// rollForward: its PENDING keys and the versions dated after the
+// transaction date, which never took effect. Versions already in effect
+// stay for asOf and history.
+func dropPending(stub shim.ChaincodeStubInterface, ref entityRef) error {
+	today, err := txDate(stub)
+	if err != nil {
+		return err
+	}
+	startKey, endKey, err := prefixRange(ref.versionKeyType(), ref.ids...)
+	if err != nil {
+		return err
+	}
+	versionKeys, err := scanKeys(stub, startKey, endKey)
+	if err != nil {
+		return err
+	}
+
+	for _, versionKey := range versionKeys {
+		_, parts := splitCompositeKey(versionKey)
+		effectiveDate := parts[len(parts)-2]
+		pendingKey, err := compositeKey(pendingKeyType, append([]string{effectiveDate, ref.docType}, ref.ids...)...)
+		if err != nil {
+			return err
+		}
+		if err = stub.DelState(pendingKey); err != nil {
+			return err
+		}
+		if effectiveDate > today {
+			if err = stub.DelState(versionKey); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ensureBaseline gives an entity written before versioning existed a first
+// version built from its head, so that dating a change does not hide its
+// earlier state from asOf queries.
+func ensureBaseline(stub shim.ChaincodeStubInterface, ref entityRef, headDate string) error {
+	startKey, endKey, err := prefixRange(ref.versionKeyType(), ref.ids...)
+	if err != nil {
+		return err
+	}
+	existing, err := scanKeys(stub, startKey, endKey)
+	if err != nil || len(existing) > 0 {
+		return err
+	}
+
+	key, err := ref.key()
+	if err != nil {
+		return err
+	}
+	head := ref.newRecord()
+	if err = getEntity(stub, ref.docType, key, head); err != nil {
+		return err
+	}
+	if headDate == "" {
+		headDate = baselineDate
+	}
+
+	return recordVersion(stub, ref, headDate, head)
+}
+
+// commitVersion records record, a pointer returned by newRecord, as the
+// version of ref in effect from effectiveDate. The head follows at once
+// unless the change is dated in the future; it reports whether it is pending.
+func commitVersion(stub shim.ChaincodeStubInterface, ref entityRef, effectiveDate string, record interface{}) (bool, error) {
+	if err := recordVersion(stub, ref, effectiveDate, record); err != nil {
+		return false, err
+	}
+
+	today, err := txDate(stub)
+	if err != nil {
+		return false, err
+	}
+	if effectiveDate > today {
+		fmt.Printf("*** %s %v change pending until %s\n", ref.docType, ref.ids, effectiveDate)
+		return true, nil
+	}
+
+	_, err = refreshHead(stub, ref)
+	return false, err
+}
+
+// latestVersion loads into record the entity's most recently dated version
+// and returns its effective date.
+func latestVersion(stub shim.ChaincodeStubInterface, ref entityRef, record interface{}) (string, bool, error) {
+	startKey, endKey, err := prefixRange(ref.versionKeyType(), ref.ids...)
+	if err != nil {
+		return "", false, err
+	}
+	iter, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return "", false, err
+	}
+	defer iter.Close()
+
+	var lastKey string
+	var value []byte
+	for iter.HasNext() {
+		if lastKey, value, err = iter.Next(); err != nil {
+			return "", false, err
+		}
+	}
+	if value == nil {
+		return "", false, nil
+	}
+
+	if err = json.Unmarshal(value, record); err != nil {
+		return "", false, errorf(codeInternal, "Corrupt %s version for %v: %s", ref.docType, ref.ids, err)
+	}
+	if err = openRecord(stub, record); err != nil {
+		return "", false, err
+	}
+	_, parts := splitCompositeKey(lastKey)
+
+	return parts[len(parts)-2], true, nil
+}
+
+// baseVersion loads the version a change effective on date applies to: the
+// entity's latest version. Changes may not be dated before that version,
+// otherwise the later version would silently mask them. Records that predate
+// versioning first get a baseline version dated headDate.
+func baseVersion(stub shim.ChaincodeStubInterface, ref entityRef, headDate, date string, record interface{}) error {
+	if err := ensureBaseline(stub, ref, headDate); err != nil {
+		return err
+	}
+
+	latest, found, err := latestVersion(stub, ref, record)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errorf(codeInternal, "%s %v has no versions", ref.docType, ref.ids)
+	}
+	if date < latest {
+		return errorf(codeValidation, "A %s %v change effective %s is already recorded; changes may not be dated before it", ref.docType, ref.ids, latest).withField("effectiveDate")
+	}
+
+	return nil
+}
+
+// changeMessage is the response payload of an invoke that changed an entity.
+func changeMessage(what, done, date string, pending bool) []byte {
+	if pending {
+		return []byte(what + " " + done + ", pending until " + date)
+	}
+
+	return []byte(what + " " + done + " succesfully!")
+}
+
+// changeDate returns the effective date of a change: args[idx] when given,
+// otherwise the transaction date.
+func changeDate(stub shim.ChaincodeStubInterface, args []string, idx int) (string, error) {
+	if len(args) > idx && args[idx] != "" {
+		if _, err := parseDate("effectiveDate", args[idx]); err != nil {
+			return "", err
+		}
+		return args[idx], nil
+	}
+
+	return txDate(stub)
+}
+
+// firstDate returns the first non-empty date, or the transaction date.
+func firstDate(stub shim.ChaincodeStubInterface, dates ...string) (string, error) {
+	for _, date := range dates {
+		if date != "" {
+			return date, nil
+		}
+	}
+
+	return txDate(stub)
+}
+
+// rollForward - invoke function that promotes every pending change whose
+// effective date has arrived to the head of its entity. The optional
+// argument is a YYYY-MM-DD date no later than the transaction date; it
+// defaults to the transaction date. Meant to be called daily by a scheduler.
+func (t *SimpleChaincode) rollForward(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting 0 or 1")
+	}
+
+	today, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	date, err := changeDate(stub, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if date > today {
+		return nil, errorf(codeBadRequest, "Cannot roll forward to %s, after the transaction date %s", date, today).withField("date")
+	}
+
+	startKey, _, err := prefixRange(pendingKeyType)
+	if err != nil {
+		return nil, err
+	}
+	pendingKeys, err := scanKeys(stub, startKey, startKey+date+keySeparator+maxKeySuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	promoted := []string{}
+	seen := map[string]bool{}
+	for _, pendingKey := range pendingKeys {
+		_, parts := splitCompositeKey(pendingKey)
+		ref := entityRef{parts[1], parts[2:]}
+		key, err := ref.key()
+		if err != nil {
+			return nil, err
+		}
+
+		if !seen[key] {
+			seen[key] = true
+			refreshed, err := refreshHead(stub, ref)
+			if err != nil {
+				return nil, err
+			}
+			if refreshed {
+				promoted = append(promoted, key)
+			}
+		}
+		if err = stub.DelState(pendingKey); err != nil {
+			return nil, err
+		}
+	}
+	fmt.Printf("*** rolled forward %d entities to %s\n", len(promoted), date)
+
+	return json.Marshal(promoted)
+}
+
+// asOf - query function returning an entity, or an account's split table, as
+// it was valid on a business date. args are the type (marketer, account,
+// assignment or splitTable), the YYYY-MM-DD date and the entity's ids.
+func (t *SimpleChaincode) asOf(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 3 {
+		return nil, newError(codeBadRequest, "Incorrect number of arguments. Expecting type, date and ids")
+	}
+	docType, date, ids := args[0], args[1], args[2:]
+	if _, err := parseDate("date", date); err != nil {
+		return nil, err
+	}
+
+	if docType == "splitTable" {
+		if err := checkArgCount(ids, 2); err != nil {
+			return nil, err
+		}
+		return splitTableAsOf(stub, ids[0], ids[1], date)
+	}
+
+	ref := entityRef{docType, ids}
+	key, err := ref.key()
+	if err != nil {
+		return nil, err
+	}
+	record := ref.newRecord()
+	found, err := versionAsOf(stub, ref, date, record)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errorf(codeNotFound, "No %s in effect on %s", docType, date).withKey(key)
+	}
+	presentRecord(stub, record)
+
+	return json.Marshal(recordEnvelope{
+		Type:          docType,
+		Key:           key,
+		SchemaVersion: schemaVersion,
+		AsOf:          date,
+		Record:        record,
+	})
+}
+
+// splitTableAsOf builds an account's split table from the assignment
+// versions in effect on date.
+func splitTableAsOf(stub shim.ChaincodeStubInterface, policyPrefix, accountNumber, date string) ([]byte, error) {
+	current, err := accountAssignments(stub, policyPrefix, accountNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	var assignments []AssignmentStruct
+	for _, head := range current {
+		var assignStruct AssignmentStruct
+		found, err := versionAsOf(stub, assignmentRef(head.AssignmentId), date, &assignStruct)
+		if err != nil {
+			return nil, err
+		}
+		if found && assignStruct.PolicyPrefix == policyPrefix && assignStruct.AccountNumber == accountNumber {
+			assignments = append(assignments, assignStruct)
+		}
+	}
+
+	table, err := buildSplitTable(policyPrefix, accountNumber, date, assignments)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(table)
+}
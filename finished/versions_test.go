@@ -0,0 +1,143 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// legalNameAsOf returns the legal name of marketer E1 on date.
+func legalNameAsOf(t *testing.T, cc *SimpleChaincode, stub *testStub, date string) (string, error) {
+	payload, err := cc.Query(stub, "asOf", []string{"marketer", date, "E1"})
+	if err != nil {
+		return "", err
+	}
+	var envelope recordEnvelope
+	envelope.Record = new(MarketerStruct)
+	if err = json.Unmarshal(payload, &envelope); err != nil {
+		t.Fatalf("asOf %s returned %s: %v", date, payload, err)
+	}
+	if envelope.AsOf != date || envelope.Key != "MARKETER~E1" {
+		t.Errorf("asOf %s returned the envelope %+v", date, envelope)
+	}
+
+	return envelope.Record.(*MarketerStruct).LegalName, nil
+}
+
+// pendingKeys returns the keys waiting for rollForward.
+func pendingKeys(stub *testStub) []string {
+	var keys []string
+	for key := range stub.State {
+		if strings.HasPrefix(key, pendingKeyType+keySeparator) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func TestFutureDatedChangesWaitForRollForward(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 1)
+
+	// Transactions run on 2017-07-14.
+	payload, err := stub.invoke(cc, "updateMarketer", `{"eId":"E1","legalName":"Ann Lane"}`, "2017-08-01")
+	if err != nil {
+		t.Fatalf("updateMarketer dated 2017-08-01 failed: %v", err)
+	}
+	if !strings.Contains(string(payload), "2017-08-01") {
+		t.Errorf("updateMarketer dated 2017-08-01: got %q, want it reported as pending", payload)
+	}
+	if mktrStruct, _ := readTestMarketer(t, cc, stub, "E1"); mktrStruct.LegalName != "Ann Lee" {
+		t.Errorf("head after a future-dated update: got %q, want Ann Lee", mktrStruct.LegalName)
+	}
+	if keys := pendingKeys(stub); len(keys) != 1 {
+		t.Errorf("pending keys after a future-dated update: got %q, want one", keys)
+	}
+
+	if payload, err = stub.invoke(cc, "rollForward"); err != nil || string(payload) != "[]" {
+		t.Errorf("rollForward before the date: got %q, %v; want nothing promoted", payload, err)
+	}
+	if payload, err = stub.invoke(cc, "rollForward", "2017-08-01"); errorCode(err) != codeBadRequest {
+		t.Errorf("rollForward to a later date: got %q, %v; want a %s error", payload, err, codeBadRequest)
+	}
+
+	stub.days = 19
+	if payload, err = stub.invoke(cc, "rollForward"); err != nil || string(payload) != `["MARKETER~E1"]` {
+		t.Errorf("rollForward on 2017-08-02: got %q, %v; want MARKETER~E1 promoted", payload, err)
+	}
+	if mktrStruct, _ := readTestMarketer(t, cc, stub, "E1"); mktrStruct.LegalName != "Ann Lane" {
+		t.Errorf("head after rollForward: got %q, want Ann Lane", mktrStruct.LegalName)
+	}
+	if keys := pendingKeys(stub); len(keys) != 0 {
+		t.Errorf("pending keys after rollForward: got %q, want none", keys)
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 3)
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E1","legalName":"Ann Lane"}`, "2017-03-01")
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E1","legalName":"Ann Long"}`, "2017-09-01")
+
+	for date, want := range map[string]string{
+		"2017-01-01": "Ann Lee",
+		"2017-02-28": "Ann Lee",
+		"2017-03-01": "Ann Lane",
+		"2017-08-31": "Ann Lane",
+		"2017-09-01": "Ann Long",
+	} {
+		if got, err := legalNameAsOf(t, cc, stub, date); err != nil || got != want {
+			t.Errorf("asOf %s: got %q, %v; want %q", date, got, err, want)
+		}
+	}
+	if got, err := legalNameAsOf(t, cc, stub, "2016-12-31"); errorCode(err) != codeNotFound {
+		t.Errorf("asOf before the marketer took effect: got %q, %v; want a %s error", got, err, codeNotFound)
+	}
+	if _, err := cc.Query(stub, "asOf", []string{"marketer", "2017-13-01", "E1"}); errorCode(err) != codeValidation {
+		t.Errorf("asOf an invalid date: got %v, want a %s error", err, codeValidation)
+	}
+
+	payload, err := cc.Query(stub, "asOf", []string{"splitTable", "2017-05-31", "P", "A1"})
+	if err != nil || !strings.Contains(string(payload), `"roles":[]`) {
+		t.Errorf("asOf splitTable before the assignment: got %s, %v; want no roles", payload, err)
+	}
+	payload, err = cc.Query(stub, "asOf", []string{"splitTable", "2017-06-01", "P", "A1"})
+	if err != nil || !strings.Contains(string(payload), `"assignmentId":"S1"`) {
+		t.Errorf("asOf splitTable once the assignment is in effect: got %s, %v; want S1", payload, err)
+	}
+}
+
+func TestDeleteDropsPendingChanges(t *testing.T) {
+	cc, stub := newTestStub(t)
+	setupRecords(t, cc, stub, 1)
+	stub.mustInvoke(t, cc, "updateMarketer", `{"eId":"E1","legalName":"Ann Lane"}`, "2017-08-01")
+	stub.mustInvoke(t, cc, "deleteMarketer", "E1")
+
+	if keys := pendingKeys(stub); len(keys) != 0 {
+		t.Errorf("pending keys after deleteMarketer: got %q, want none", keys)
+	}
+	stub.days = 19
+	if payload, err := stub.invoke(cc, "rollForward"); err != nil || string(payload) != "[]" {
+		t.Errorf("rollForward after deleteMarketer: got %q, %v; want nothing promoted", payload, err)
+	}
+	if stub.State["MARKETER~E1"] != nil {
+		t.Error("rollForward brought back the deleted MARKETER~E1")
+	}
+	if got, err := legalNameAsOf(t, cc, stub, "2017-07-01"); err != nil || got != "Ann Lee" {
+		t.Errorf("asOf before the delete: got %q, %v; want Ann Lee", got, err)
+	}
+}